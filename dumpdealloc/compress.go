@@ -0,0 +1,252 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+)
+
+// compression algorithms accepted by --compress
+var CompressAlgorithms = []string{"gzip", "zstd", "xz"}
+
+// level of NewCompressWriter meaning the default level of the algorithm
+const DefaultCompressLevel = -1
+
+// lowest and highest levels accepted by --compress-level for each algorithm
+var CompressLevels = map[string][2]int{"gzip": {1, 9}, "zstd": {1, 22}, "xz": {0, 9}}
+
+// xz presets dictionary sizes (man xz), indexed by level
+var xzDictCaps = [10]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+/**
+ * A compressor which can push what has been written on it to its output
+ * without ending the compressed stream.
+ */
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+/**
+ * Writer compressing what is written on it (--compress).
+ * Each Write is flushed to output before returning, so when Write returns
+ * the chunk is really on output and can be deallocated from FILE.
+ * Except with xz: a flush ends the xz stream (new dictionary, stream headers),
+ * so it is only flushed once the bytes written reach the dictionary size.
+ * Close must be called at the end of the dump to end the compressed stream.
+ *
+ * CompressWriter is a DurableWriter: Durable return the number of
+ * uncompressed bytes whose compressed bytes are flushed on output (and
+ * durable if output is a DurableWriter).
+ */
+type CompressWriter struct {
+	compressor    flushWriteCloser
+	output        *countingWriter
+	durableOutput DurableWriter /* nil if output isn't a DurableWriter */
+	flushEvery    int64         /* uncompressed bytes between two flushes (0: each Write) */
+	written       int64         /* uncompressed bytes */
+	flushed       int64         /* uncompressed bytes */
+	durable       int64         /* uncompressed bytes */
+	marks         []compressMark
+}
+
+// offsets in the uncompressed and compressed streams at the end of a Write
+type compressMark struct {
+	uncompressed int64
+	compressed   int64
+}
+
+/**
+ * Create a CompressWriter on output with algorithm (one of CompressAlgorithms)
+ * and level (in CompressLevels, or DefaultCompressLevel).
+ *
+ * Can return: nil, ErrUnknownCompression, ErrCompressLevel or compressor errors
+ */
+func NewCompressWriter(output io.Writer, algorithm string, level int) (*CompressWriter, error) {
+	var compressor flushWriteCloser
+	var flushEvery int64
+	var err error
+
+	levels, known := CompressLevels[algorithm]
+	if !known {
+		return nil, ErrUnknownCompression
+	}
+	if level != DefaultCompressLevel && (level < levels[0] || level > levels[1]) {
+		return nil, ErrCompressLevel
+	}
+
+	durableOutput, _ := output.(DurableWriter)
+	output = &countingWriter{writer: output}
+
+	switch algorithm {
+	case "gzip":
+		if level == DefaultCompressLevel {
+			level = gzip.DefaultCompression
+		}
+		compressor, err = gzip.NewWriterLevel(output, level)
+	case "zstd":
+		options := []zstd.EOption{}
+		if level != DefaultCompressLevel {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		compressor, err = zstd.NewWriter(output, options...)
+	case "xz":
+		if level == DefaultCompressLevel {
+			level = 6 /* xz default preset */
+		}
+		compressor = &xzStreamsWriter{output: output, config: xz.WriterConfig{DictCap: xzDictCaps[level]}}
+		// a shorter stream doesn't use its whole dictionary
+		flushEvery = int64(xzDictCaps[level])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompressWriter{
+		compressor:    compressor,
+		output:        output.(*countingWriter),
+		durableOutput: durableOutput,
+		flushEvery:    flushEvery,
+	}, nil
+}
+
+var ErrUnknownCompression = errors.New("unknown compression algorithm")
+var ErrCompressLevel = errors.New("compression level out of range for this compression algorithm")
+
+// Compress buffer and flush it to output (xz: once flushEvery bytes are written)
+func (writer *CompressWriter) Write(buffer []byte) (nbByteWritten int, err error) {
+	nbByteWritten, err = writer.compressor.Write(buffer)
+	if err != nil {
+		return nbByteWritten, err
+	}
+
+	if writer.written+int64(nbByteWritten)-writer.flushed < writer.flushEvery {
+		writer.written += int64(nbByteWritten)
+		return nbByteWritten, nil
+	}
+	err = writer.compressor.Flush()
+	if err != nil {
+		// nothing is sure to be on output
+		return 0, err
+	}
+
+	writer.written += int64(nbByteWritten)
+	writer.flushed = writer.written
+	if writer.durableOutput != nil {
+		writer.marks = append(writer.marks, compressMark{writer.written, writer.output.written})
+	}
+
+	return nbByteWritten, nil
+}
+
+// Number of uncompressed bytes written whose compressed bytes are flushed and durable on output
+func (writer *CompressWriter) Durable() int64 {
+	if writer.durableOutput == nil {
+		return writer.flushed
+	}
+
+	outputDurable := writer.durableOutput.Durable()
+	for len(writer.marks) > 0 && writer.marks[0].compressed <= outputDurable {
+		writer.durable = writer.marks[0].uncompressed
+		writer.marks = writer.marks[1:]
+	}
+	return writer.durable
+}
+
+// Flush all the written bytes on output and make them durable (if it's a DurableWriter)
+func (writer *CompressWriter) Flush() error {
+	if writer.flushed < writer.written {
+		err := writer.compressor.Flush()
+		if err != nil {
+			return err
+		}
+		writer.flushed = writer.written
+		if writer.durableOutput != nil {
+			writer.marks = append(writer.marks, compressMark{writer.written, writer.output.written})
+		}
+	}
+	if writer.durableOutput == nil {
+		return nil
+	}
+
+	err := writer.durableOutput.Flush()
+	if err != nil {
+		return err
+	}
+	writer.Durable()
+	return nil
+}
+
+// End the compressed stream
+func (writer *CompressWriter) Close() error {
+	return writer.compressor.Close()
+}
+
+/**
+ * xz can't be flushed in the middle of a stream, so each flush end the
+ * current xz stream and the next Write start a new one.
+ * Concatenated xz streams are a valid xz file (xz -d handles them).
+ */
+type xzStreamsWriter struct {
+	output      io.Writer
+	config      xz.WriterConfig
+	stream      *xz.Writer /* nil between two streams */
+	streamCount int
+}
+
+func (writer *xzStreamsWriter) Write(buffer []byte) (int, error) {
+	if writer.stream == nil {
+		stream, err := writer.config.NewWriter(writer.output)
+		if err != nil {
+			return 0, err
+		}
+		writer.stream = stream
+		writer.streamCount++
+	}
+	return writer.stream.Write(buffer)
+}
+
+func (writer *xzStreamsWriter) Flush() error {
+	if writer.stream == nil {
+		return nil
+	}
+	err := writer.stream.Close()
+	writer.stream = nil
+	return err
+}
+
+func (writer *xzStreamsWriter) Close() error {
+	// an empty input still has to give a valid xz file
+	if writer.streamCount == 0 {
+		_, err := writer.Write(nil)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,145 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompressWriter(t *testing.T) {
+	testContent, err := ioutil.ReadFile("../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressors := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(input io.Reader) (io.Reader, error) { return gzip.NewReader(input) },
+		"zstd": func(input io.Reader) (io.Reader, error) { return zstd.NewReader(input) },
+		"xz":   func(input io.Reader) (io.Reader, error) { return xz.NewReader(input) },
+	}
+
+	for _, algorithm := range CompressAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			outputBuffer := new(bytes.Buffer)
+			compressor, err := NewCompressWriter(outputBuffer, algorithm, DefaultCompressLevel)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// write by chunk, each one should be flushed on output (xz: only
+			// once the dictionary size is written)
+			for chunkStart := 0; chunkStart < len(testContent); chunkStart += 4096 {
+				chunkEnd := chunkStart + 4096
+				if chunkEnd > len(testContent) {
+					chunkEnd = len(testContent)
+				}
+				outputLenBefore := outputBuffer.Len()
+
+				_, err = compressor.Write(testContent[chunkStart:chunkEnd])
+				if err != nil {
+					t.Fatal(err)
+				}
+				// LICENSE is smaller than the xz dictionary
+				expectedDurable := int64(chunkEnd)
+				if algorithm == "xz" {
+					expectedDurable = 0
+				} else if outputBuffer.Len() == outputLenBefore {
+					t.Fatalf("chunk %d hasn't been flushed on output", chunkStart)
+				}
+				if compressor.Durable() != expectedDurable {
+					t.Errorf("durable, expected: %d, got: %d", expectedDurable, compressor.Durable())
+				}
+			}
+
+			err = compressor.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressor.Durable() != int64(len(testContent)) {
+				t.Errorf("durable after flush, expected: %d, got: %d", len(testContent), compressor.Durable())
+			}
+			err = compressor.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decompressor, err := decompressors[algorithm](outputBuffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := ioutil.ReadAll(decompressor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(testContent, decompressed) {
+				t.Error("decompressed content differ from the original")
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := NewCompressWriter(new(bytes.Buffer), "bzip2", DefaultCompressLevel)
+		if err != ErrUnknownCompression {
+			t.Errorf("expected error %v, got: %v", ErrUnknownCompression, err)
+		}
+	})
+
+	levelCases := []struct {
+		algorithm string
+		level     int
+		expectedE error
+	}{
+		{"gzip", 0,  ErrCompressLevel},
+		{"gzip", 9,  nil},
+		{"zstd", 23, ErrCompressLevel},
+		{"xz",   0,  nil},
+		{"xz",   -2, ErrCompressLevel},
+	}
+	for _, tc := range levelCases {
+		t.Run(fmt.Sprintf("%s level %d", tc.algorithm, tc.level), func(t *testing.T) {
+			_, err := NewCompressWriter(new(bytes.Buffer), tc.algorithm, tc.level)
+			if err != tc.expectedE {
+				t.Errorf("expected error %v, got: %v", tc.expectedE, err)
+			}
+		})
+	}
+}
+
+func TestCompressWriterDurable(t *testing.T) {
+	outputPath := "dump-deallocate-TestCompressWriterDurable"
+	defer os.Remove(outputPath)
+
+	// fdatasync only after 1MiB of compressed bytes
+	output, err := OpenFileOutput(outputPath, false, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	compressor, err := NewCompressWriter(output, "gzip", DefaultCompressLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = compressor.Write([]byte("not durable yet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressor.Durable() != 0 {
+		t.Errorf("durable, expected: 0, got: %d", compressor.Durable())
+	}
+
+	err = compressor.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressor.Durable() != int64(len("not durable yet")) {
+		t.Errorf("durable, expected: %d, got: %d", len("not durable yet"), compressor.Durable())
+	}
+}
@@ -0,0 +1,322 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Control of a running dump (--control-socket).
+ * CopyWhileDeallocate check it between chunks: it wait while the dump is
+ * paused and throttle the dump to the rate limit.
+ *
+ * Serve answer to the commands of ControlRequest on a listener, one command
+ * per line, one reply line per command:
+ *   status             offset=… written=… reclaimed=… rate=… rate-limit=… state=…
+ *   pause              ok
+ *   resume             ok
+ *   set-rate BYTES     ok (bytes per second, 0 means unlimited)
+ *   stop-after-chunk   ok
+ * On failure the reply is "error <message>".
+ */
+type Controller struct {
+	Logger *log.Logger /* the commands received, nil: no output */
+
+	mutex    sync.Mutex
+	progress Result
+	resumed  chan struct{} /* nil when running, closed on resume */
+	stop     func()
+	stopping bool
+	limiter  rateLimiter
+
+	// measure of the rate, from windowStart (the paused time excluded) up to
+	// the last chunk; windowNext become windowStart once the window last
+	// 2×controlRateWindow, so the rate cover the last 5 to 10s
+	rate            int64
+	windowStart     time.Time
+	windowStartByte int64
+	windowNext      time.Time /* zero until the window last controlRateWindow */
+	windowNextByte  int64
+}
+
+// duration over which the rate is measured (up to twice it)
+var controlRateWindow = 5 * time.Second
+
+/**
+ * Create a Controller, stop is called by StopAfterChunk and must make the
+ * dump stop between two chunks (usually the cancel of the Drain context).
+ */
+func NewController(stop func()) *Controller {
+	return &Controller{stop: stop, windowStart: time.Now()}
+}
+
+// State of a dump, as returned by the status command
+type ControlStatus struct {
+	Offset        int64 /* offset of file up to which it has been dumped */
+	ByteWritten   int64
+	ByteReclaimed int64
+	Rate          int64  /* bytes per second */
+	RateLimit     int64  /* bytes per second, 0 means unlimited */
+	State         string /* running, paused or stopping */
+}
+
+func (status ControlStatus) String() string {
+	return fmt.Sprintf("offset=%d written=%d reclaimed=%d rate=%d rate-limit=%d state=%s",
+		status.Offset, status.ByteWritten, status.ByteReclaimed, status.Rate, status.RateLimit, status.State)
+}
+
+// Return the state of the dump
+func (controller *Controller) Status() ControlStatus {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	status := ControlStatus{
+		Offset:        controller.progress.ByteDeallocated,
+		ByteWritten:   controller.progress.ByteWritten,
+		ByteReclaimed: controller.progress.ByteReclaimed,
+		Rate:          controller.rate,
+		RateLimit:     controller.limiter.Rate(),
+		State:         "running",
+	}
+	if controller.resumed != nil {
+		status.State = "paused"
+		status.Rate = 0
+	}
+	if controller.stopping {
+		status.State = "stopping"
+	}
+	return status
+}
+
+// Pause the dump after the current chunk
+func (controller *Controller) Pause() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if controller.resumed == nil {
+		controller.resumed = make(chan struct{})
+	}
+}
+
+// Resume a paused dump
+func (controller *Controller) Resume() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if controller.resumed != nil {
+		close(controller.resumed)
+		controller.resumed = nil
+	}
+}
+
+// Limit the dump to rate bytes per second (0 means unlimited)
+func (controller *Controller) SetRate(rate int64) {
+	controller.limiter.SetRate(rate)
+}
+
+// Stop the dump after the current chunk (a paused dump is resumed to stop)
+func (controller *Controller) StopAfterChunk() {
+	controller.mutex.Lock()
+	controller.stopping = true
+	controller.mutex.Unlock()
+	if controller.stop != nil {
+		controller.stop()
+	}
+	controller.Resume()
+}
+
+/**
+ * Called by CopyWhileDeallocate before reading a chunk.
+ * Wait while the dump is paused (or until ctx is done), the time paused isn't
+ * counted in the rate.
+ */
+func (controller *Controller) beforeChunk(ctx context.Context) {
+	controller.mutex.Lock()
+	resumed := controller.resumed
+	controller.mutex.Unlock()
+
+	if resumed == nil {
+		return
+	}
+	pauseStart := time.Now()
+	select {
+	case <-ctx.Done():
+	case <-resumed:
+	}
+	paused := time.Since(pauseStart)
+
+	controller.mutex.Lock()
+	controller.windowStart = controller.windowStart.Add(paused)
+	if !controller.windowNext.IsZero() {
+		controller.windowNext = controller.windowNext.Add(paused)
+	}
+	controller.mutex.Unlock()
+}
+
+/**
+ * Called by CopyWhileDeallocate once a chunk has been written and deallocated.
+ * Update the status (CopyWhileDeallocate throttle to the rate limit itself).
+ */
+func (controller *Controller) afterChunk(progress Result) {
+	controller.mutex.Lock()
+	controller.progress = progress
+	now := time.Now()
+	elapsed := now.Sub(controller.windowStart)
+	if elapsed > 0 {
+		controller.rate = int64(float64(progress.ByteWritten-controller.windowStartByte) / elapsed.Seconds())
+	}
+	if controller.windowNext.IsZero() && elapsed >= controlRateWindow {
+		controller.windowNext, controller.windowNextByte = now, progress.ByteWritten
+	}
+	if elapsed >= 2*controlRateWindow {
+		controller.windowStart, controller.windowStartByte = controller.windowNext, controller.windowNextByte
+		controller.windowNext = time.Time{}
+	}
+	controller.mutex.Unlock()
+}
+
+/**
+ * Accept connections on listener and answer their commands until listener
+ * is closed.
+ *
+ * Can return: nil or net errors
+ */
+func (controller *Controller) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go controller.handle(conn)
+	}
+}
+
+// Answer the commands of a connection until it is closed
+func (controller *Controller) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply, err := controller.execute(scanner.Text())
+		if err != nil {
+			reply = "error " + err.Error()
+		}
+		_, err = fmt.Fprintln(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+/**
+ * Execute a command line, return the reply.
+ *
+ * Can return: nil, errorUnknownCommand, errorCommandArgument or strconv errors
+ */
+func (controller *Controller) execute(line string) (reply string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errorUnknownCommand
+	}
+	command, arguments := fields[0], fields[1:]
+
+	expectedArguments := 0
+	if command == "set-rate" {
+		expectedArguments = 1
+	}
+	if len(arguments) != expectedArguments {
+		return "", errorCommandArgument
+	}
+
+	switch command {
+	case "status":
+		return controller.Status().String(), nil
+	case "pause":
+		logPrintf(controller.Logger, "control, pause")
+		controller.Pause()
+	case "resume":
+		logPrintf(controller.Logger, "control, resume")
+		controller.Resume()
+	case "set-rate":
+		rate, err := strconv.ParseInt(arguments[0], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		if rate < 0 {
+			return "", errorCommandArgument
+		}
+		logPrintf(controller.Logger, "control, set rate to %d bytes/s", rate)
+		controller.SetRate(rate)
+	case "stop-after-chunk":
+		logPrintf(controller.Logger, "control, stop after the current chunk")
+		controller.StopAfterChunk()
+	default:
+		return "", errorUnknownCommand
+	}
+	return "ok", nil
+}
+
+var errorUnknownCommand = errors.New("unknown command")
+var errorCommandArgument = errors.New("bad command arguments")
+
+/**
+ * Send command to the control socket path and return the reply
+ * (dump-deallocate ctl).
+ *
+ * Can return: nil, net errors or ErrControlCommand (the reply is then the
+ * error sent by the controller)
+ */
+func ControlRequest(path string, command string) (reply string, err error) {
+	conn, err := net.DialTimeout("unix", path, netDialTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(netAckTimeout))
+
+	_, err = fmt.Fprintln(conn, command)
+	if err != nil {
+		return "", err
+	}
+
+	reply, err = bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\n")
+	if strings.HasPrefix(reply, "error ") {
+		return strings.TrimPrefix(reply, "error "), ErrControlCommand
+	}
+	return reply, nil
+}
+
+var ErrControlCommand = errors.New("control command failed")
@@ -0,0 +1,138 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var limiter rateLimiter
+
+	// unlimited
+	start := time.Now()
+	limiter.Wait(context.Background(), 1024*1024)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited, waited %v", elapsed)
+	}
+
+	// 1000 bytes/s: 500 bytes in debt take half a second
+	limiter.SetRate(1000)
+	start = time.Now()
+	limiter.Wait(context.Background(), 500)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("1000 bytes/s, expected to wait ~500ms, waited %v", elapsed)
+	}
+
+	// ctx done, don't wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	limiter.Wait(ctx, 10000)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("ctx done, waited %v", elapsed)
+	}
+}
+
+func TestController(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "dump-deallocate-control-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "control.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestController-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	testContent := bytes.Repeat([]byte{'x'}, 64*1024)
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controller := NewController(cancel)
+	go controller.Serve(listener)
+
+	request := func(command string) string {
+		reply, err := ControlRequest(socketPath, command)
+		if err != nil {
+			t.Fatalf("%s: %v (%s)", command, err, reply)
+		}
+		return reply
+	}
+
+	// paused before the start, nothing is dumped until resume
+	if reply := request("pause"); reply != "ok" {
+		t.Fatalf("pause, expected: ok, got: %s", reply)
+	}
+
+	done := make(chan Result)
+	outputBuffer := new(bytes.Buffer)
+	go func() {
+		result, _ := Drain(ctx, file, outputBuffer, Options{BufferSize: 4096, Control: controller})
+		done <- result
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if reply := request("status"); !strings.Contains(reply, "offset=0 ") || !strings.HasSuffix(reply, "state=paused") {
+		t.Errorf("status, expected: offset=0 … state=paused, got: %s", reply)
+	}
+
+	// unknown commands are refused
+	_, err = ControlRequest(socketPath, "restart")
+	if err != ErrControlCommand {
+		t.Errorf("restart, expected error %v, got: %v", ErrControlCommand, err)
+	}
+
+	request("set-rate 40960")
+	if reply := request("status"); !strings.Contains(reply, "rate-limit=40960 ") {
+		t.Errorf("status, expected: rate-limit=40960, got: %s", reply)
+	}
+
+	// throttled to 10 chunks/s, stop after 2-3 chunks
+	// the rate is measured from the resume, before controlRateWindow
+	request("resume")
+	time.Sleep(250 * time.Millisecond)
+	if reply := request("status"); strings.Contains(reply, "rate=0 ") {
+		t.Errorf("status, expected a rate, got: %s", reply)
+	}
+	request("stop-after-chunk")
+
+	select {
+	case result := <-done:
+		if !result.Interrupted {
+			t.Error("expected interrupted dump")
+		}
+		if result.ByteWritten == 0 || result.ByteWritten >= int64(len(testContent)) {
+			t.Errorf("written, expected: between 0 and %d, got: %d", len(testContent), result.ByteWritten)
+		}
+		if !bytes.Equal(testContent[:result.ByteWritten], outputBuffer.Bytes()) {
+			t.Error("content hasn't been copied correctly")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the dump didn't stop")
+	}
+}
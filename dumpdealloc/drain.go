@@ -0,0 +1,360 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+/**
+ * Package dumpdealloc copies a file to a writer while deallocating
+ * (fallocate punch-hole) the bytes already copied, so the copy doesn't need
+ * more free space than the size of its buffer.
+ *
+ * It is the library behind the dump-deallocate command.
+ */
+package dumpdealloc
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// default size of the buffer used to copy file to output
+const DefaultBufferSize int64 = 32 * 1024 /* 32KiB */
+
+// what Drain does to file once it has been dumped
+type EndAction int
+
+const (
+	EndNone     EndAction = iota /* leave file sparse */
+	EndCollapse                  /* collapse the deallocated start of file */
+	EndTruncate                  /* truncate file to 0 */
+	EndRemove                    /* remove file */
+)
+
+func (action EndAction) String() string {
+	switch action {
+	case EndCollapse:
+		return "collapse"
+	case EndTruncate:
+		return "truncate"
+	case EndRemove:
+		return "remove"
+	}
+	return "none"
+}
+
+/**
+ * Functions called by Drain during the dump, nil ones are ignored.
+ * - AfterChunk: after each chunk written on output (and deallocated)
+ * - AfterDump:  once file has been dumped, before the end action. Used to end
+ *               the stream written on output (compression, flush…), if it
+ *               return an error the end action isn't done.
+ */
+type Hooks struct {
+	AfterChunk func(progress Result)
+	AfterDump  func(result Result) error
+}
+
+// Parameters of Drain, the zero value dump file once without touching it afterward
+type Options struct {
+	BufferSize      int64         /* size of the chunks (memory buffer), 0 means DefaultBufferSize */
+	Follow          bool          /* wait for bytes appended to file instead of stopping at its end */
+	IdleTimeout     time.Duration /* with Follow, stop after this long without new bytes (0: never) */
+	Checkpoint      *State        /* record the progress after each chunk, resume from it */
+	DumpLeadingHole bool          /* don't skip the leading hole of file (ignored with Checkpoint) */
+	RequireReclaim  bool          /* fail (ErrNothingReclaimed) if the punch-holes don't free anything (st_blocks) */
+	Snapshot        bool          /* only dump file up to its size at the start (Result.SnapshotSize), see Drain */
+	Force           bool          /* do the end action even if other processes have file open */
+	Exclusive       bool          /* the caller promise no other process has file open (CollapseEvery) */
+
+	// keep the last PunchLag bytes written allocated until the end of the
+	// dump, on error they are still in file after Result.SafeResumeOffset
+	PunchLag int64
+
+	// bytes dumped and punch-holes (fallocate calls) per second, token
+	// buckets (0: unlimited), the rate limit of Control replace Rate
+	Rate   int64
+	MaxOps int64
+
+	// once this many bytes at the start of file are punched, collapse them
+	// if no other process has file open (Exclusive or a write lease), the
+	// offsets of Result are then the ones of file after the collapses (see
+	// Result.ByteCollapsed); 0: never, ignored with Checkpoint
+	CollapseEvery int64
+
+	// how the dumped bytes are deallocated (StrategyAuto is punch-hole,
+	// nothing is deallocated with StrategyCopyRename), see Drain
+	Strategy Strategy
+
+	// with InFlight > 1 (ignored with CollapseEvery), a goroutine reads up to
+	// InFlight chunks ahead of the writes and another one does the punch-holes
+	// (up to InFlight queued), in the order of file and only once the chunks
+	// are written; each chunk has its own buffer, so zero-copy isn't used
+	InFlight int
+
+	// pause (between two chunks), throttle and query the dump
+	Control *Controller
+
+	// warnings of the dump (filesystem which can't punch holes or collapse,
+	// punch-holes freeing nothing…), nil: no output
+	Logger *log.Logger
+
+	EndAction EndAction
+	Hooks     Hooks
+
+	// called by CopyWhileDeallocate at the end of file, the dump continue
+	// if it returns true (see safeTruncater)
+	atEOF func(offset int64) (more bool, err error)
+}
+
+// Print a message on logger, nothing if logger is nil
+func logPrintf(logger *log.Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+}
+
+// What Drain did
+type Result struct {
+	StartOffset      int64     /* offset of file where the dump started */
+	ByteDeallocated  int64     /* offset of file up to which it has been dumped and deallocated */
+	ByteRead         int64     /* bytes read from file */
+	ByteWritten      int64     /* bytes written on output */
+	ByteFreed        int64     /* bytes freed according to the punch-holes (whole blocks) */
+	ByteReclaimed    int64     /* bytes freed according to st_blocks */
+	BlocksStart      int64     /* st_blocks (512 bytes unit) of file before the dump */
+	BlocksEnd        int64     /* st_blocks of file at the end of the dump */
+	ByteCollapsed    int64     /* bytes removed from the start of file by collapses (CollapseEvery, EndCollapse) or the rewrite */
+	SafeResumeOffset int64     /* file can be dumped again from this offset without losing bytes */
+	SnapshotSize     int64     /* with Options.Snapshot, size of file at the start of the dump */
+	EndLock          string    /* with EndTruncate, lock of file taken: "lease", "flock", "none" or "" */
+	Strategy         Strategy  /* deallocation strategy used */
+	EndAction        EndAction /* end action of file: options.EndAction, EndCollapse with StrategyCopyRename */
+	ZeroCopy         string    /* syscall writing on output without buffer: "splice", "sendfile", "copy_file_range" or "" */
+	Dumped           bool      /* file has been dumped, the error (if any) come from the end */
+	Interrupted      bool      /* the dump stopped on ctx before the end of file, it is dumped up to SafeResumeOffset */
+}
+
+/**
+ * Dump file to output while deallocating it, then do options.EndAction.
+ *
+ * The dump start at the current read offset of file, after the leading hole
+ * of file (already deallocated by an interrupted run) or at the committed
+ * offset of options.Checkpoint.
+ * When ctx is done, the dump stop after the current chunk (written on output
+ * and deallocated), Result.Interrupted is set and the end action isn't done
+ * (unless options.Follow, where ctx is the normal way to stop).
+ * options.Hooks.AfterDump is still called, so the stream written on output
+ * can be ended.
+ *
+ * With EndTruncate, file is locked (lease or flock, see Result.EndLock) once
+ * its end is reached, the bytes appended meanwhile are dumped, then file is
+ * truncated only if its size is still the offset dumped. Otherwise (or if
+ * another process holds a flock on file) it is left dumped, with its holes,
+ * and ErrTruncateRefused is returned.
+ *
+ * With EndRemove file is removed by name, the caller still has to close it.
+ *
+ * The dumped bytes are deallocated with options.Strategy, StrategyAuto is
+ * chosen by probing punch-hole on file before anything is read (see
+ * chooseStrategy): punch-hole, else copy-rename. With copy-rename
+ * nothing is deallocated during the dump; at the end (EndNone or
+ * EndCollapse, see Result.EndAction) the bytes not dumped are copied in a
+ * new file renamed over file (see rewriteFrom, ErrRewriteRefused).
+ * EndCollapse falls back to the same rewrite when the filesystem can't
+ * collapse (EOPNOTSUPP).
+ * With options.RequireReclaim, only punch-hole is accepted (*StrategyError).
+ *
+ * Unless options.Force, the end action is refused (file is left dumped, with
+ * its holes) if other processes have file open (see FindOpeners).
+ *
+ * With options.Snapshot, file is dumped up to the size it had at the start
+ * (the bytes appended during the dump are left in file) and the end action
+ * only concern this range: collapse only remove dumped blocks, truncate and
+ * remove are refused (ErrFileGrown) if file grew.
+ *
+ * When the error come from the dump (Result.Dumped is false), the bytes of
+ * file after Result.SafeResumeOffset are still there and file can be dumped
+ * again from it. With options.Follow, ErrFileTruncated means file has been
+ * truncated below the offset dumped: its bytes aren't the ones dumped anymore,
+ * the end action isn't done.
+ *
+ * Can return: nil, the errors of CopyWhileDeallocate, *CollapseError,
+ * *os.PathError, ctx.Err(), ErrFileGrown, ErrTruncateRefused, *OpenersError,
+ * *StrategyError, ErrRewriteRefused or the error of options.Hooks.AfterDump
+ */
+func Drain(ctx context.Context, file *os.File, output io.Writer, options Options) (result Result, err error) {
+	// before anything is read, file is untouched on error
+	options.Strategy, err = chooseStrategy(file, options.Strategy, options.RequireReclaim, options.Logger)
+	result.Strategy = options.Strategy
+	result.EndAction = options.EndAction
+	if err != nil {
+		return result, err
+	}
+	if options.Strategy == StrategyCopyRename && options.EndAction == EndNone {
+		// the dumped bytes can only be removed by the rewrite
+		options.EndAction = EndCollapse
+		result.EndAction = EndCollapse
+	}
+
+	if options.Checkpoint != nil {
+		// resume where the previous run stopped
+		result.SafeResumeOffset = options.Checkpoint.committed
+		_, err = file.Seek(options.Checkpoint.committed, io.SeekStart)
+		if err != nil {
+			return result, &os.PathError{Op: "seek", Path: file.Name(), Err: err}
+		}
+		// the previous run may have stopped before its last punch-hole
+		switch options.Strategy {
+		case StrategyPunchHole:
+			err = DeallocateUpTo(file, options.Checkpoint.committed)
+		case StrategyZeroRange:
+			err = ZeroRange(file, 0, options.Checkpoint.committed)
+		}
+		if err != nil {
+			return result, err
+		}
+	} else if !options.DumpLeadingHole {
+		// the leading hole of file has already been dumped by a previous
+		// interrupted run, we consider it as already deallocated
+		result.SafeResumeOffset, err = SkipHole(file)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	var truncater *safeTruncater
+	if options.EndAction == EndTruncate {
+		truncater = &safeTruncater{file: file}
+		defer truncater.release()
+		// with Snapshot, the bytes appended aren't dumped
+		if !options.Snapshot {
+			options.atEOF = truncater.atEOF
+		}
+	}
+
+	err = CopyWhileDeallocate(ctx, file, output, options, &result)
+	if err != nil {
+		return result, err
+	}
+	result.Dumped = !result.Interrupted
+
+	if options.Hooks.AfterDump != nil {
+		err = options.Hooks.AfterDump(result)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.Interrupted {
+		// file isn't fully dumped
+		return result, ctx.Err()
+	}
+
+	// less than reclaimCheckAfter bytes punched, CopyWhileDeallocate didn't check
+	if options.RequireReclaim && result.ByteFreed > 0 && result.ByteReclaimed == 0 {
+		return result, ErrNothingReclaimed
+	}
+
+	// the bytes appended after the snapshot would be lost
+	if options.Snapshot && (options.EndAction == EndTruncate || options.EndAction == EndRemove) {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return result, err
+		}
+		if fileInfo.Size() > result.SnapshotSize-result.ByteCollapsed {
+			return result, ErrFileGrown
+		}
+	}
+
+	// a writer would keep writing at its offset (in a removed file, or
+	// after a truncate/collapse, adding back the bytes removed as zeros)
+	if options.EndAction != EndNone && !options.Force {
+		openers, leaseBusy, err := FindOpeners(file)
+		if err != nil {
+			return result, err
+		}
+		if len(openers) > 0 || leaseBusy {
+			return result, &OpenersError{Action: options.EndAction, Openers: openers}
+		}
+	}
+
+	switch options.EndAction {
+	case EndCollapse:
+		// we can't collapse the whole file, so we make sure to keep at
+		// least one byte
+		var byteCollapsed int64
+		if options.Strategy != StrategyCopyRename {
+			byteCollapsed, err = CollapseFileStart(file, result.ByteDeallocated-1)
+			if err == errorZero || err == errorLessThanOneFsb {
+				// not a whole filesystem block to collapse, file is already as small as it gets
+				err = nil
+			}
+		}
+		if options.Strategy == StrategyCopyRename || errors.Is(err, unix.EOPNOTSUPP) {
+			// the filesystem can't collapse, the rewrite gives the same file
+			byteCollapsed, err = rewriteFrom(file, result.ByteDeallocated)
+		}
+		result.ByteCollapsed += byteCollapsed
+		if err != nil {
+			return result, err
+		}
+		if options.Checkpoint != nil {
+			// the bytes of file moved backward
+			err = options.Checkpoint.Shift(-byteCollapsed)
+			if err != nil {
+				return result, err
+			}
+		}
+
+	case EndTruncate:
+		// erase (collapse) the read bytes from file
+		err = truncater.truncate(result.ByteDeallocated)
+		result.EndLock = truncater.lockKind()
+		if err != nil {
+			return result, err
+		}
+		if options.Checkpoint != nil {
+			err = options.Checkpoint.Shift(-result.ByteDeallocated)
+			if err != nil {
+				return result, err
+			}
+		}
+
+	case EndRemove:
+		err = os.Remove(file.Name())
+		if err != nil {
+			return result, err
+		}
+		// the state of a removed file is useless
+		if options.Checkpoint != nil {
+			err = options.Checkpoint.Remove()
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+var ErrNothingReclaimed = errors.New("the punch-holes freed nothing")
+var ErrFileGrown = errors.New("the file grew since the snapshot, end action refused")
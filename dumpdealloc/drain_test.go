@@ -0,0 +1,526 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDrainInterrupted(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainInterrupted-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(4*fsBlockSize))
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted during the first chunk
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	afterDumpCalled := false
+	options := Options{
+		BufferSize: fsBlockSize,
+		EndAction:  EndTruncate,
+		Hooks: Hooks{
+			AfterChunk: func(Result) { cancel() },
+			AfterDump:  func(Result) error { afterDumpCalled = true; return nil },
+		},
+	}
+
+	outputBuffer := new(bytes.Buffer)
+	result, err := Drain(ctx, file, outputBuffer, options)
+
+	if err != context.Canceled || !result.Interrupted || result.Dumped {
+		t.Fatalf("expected interrupted, got: %v interrupted=%v dumped=%v", err, result.Interrupted, result.Dumped)
+	}
+	if !afterDumpCalled {
+		t.Error("AfterDump hasn't been called")
+	}
+	// the first chunk is finished, nothing more
+	if !bytes.Equal(testContent[:fsBlockSize], outputBuffer.Bytes()) {
+		t.Errorf("output, expected the first %d bytes, got %d bytes", fsBlockSize, outputBuffer.Len())
+	}
+	if result.SafeResumeOffset != fsBlockSize || result.ByteFreed != fsBlockSize {
+		t.Errorf("resume offset and freed, expected: %d %d, got: %d %d",
+			fsBlockSize, fsBlockSize, result.SafeResumeOffset, result.ByteFreed)
+	}
+
+	// the end action (truncate) has been skipped
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() != int64(len(testContent)) {
+		t.Errorf("size, expected: %d, got: %d, see '%s'", len(testContent), fileInfo.Size(), file.Name())
+	}
+}
+
+// output durable once flushed, it cancel ctx (signal received at the end of the dump)
+type cancelOnFlush struct {
+	bytes.Buffer
+	durable int64
+	cancel  context.CancelFunc
+}
+
+func (output *cancelOnFlush) Durable() int64 { return output.durable }
+
+func (output *cancelOnFlush) Flush() error {
+	output.durable = int64(output.Len())
+	output.cancel()
+	return nil
+}
+
+func TestDrainCanceledAfterEOF(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainCanceledAfterEOF-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(4*fsBlockSize))
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	output := &cancelOnFlush{cancel: cancel}
+	result, err := Drain(ctx, file, output, Options{BufferSize: fsBlockSize, EndAction: EndTruncate})
+
+	// the whole file has been read before ctx was done
+	if err != nil || result.Interrupted || !result.Dumped {
+		t.Fatalf("expected dumped, got: %v interrupted=%v dumped=%v", err, result.Interrupted, result.Dumped)
+	}
+	if !bytes.Equal(testContent, output.Bytes()) {
+		t.Errorf("output, expected %d bytes, got %d bytes", len(testContent), output.Len())
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() != 0 {
+		t.Errorf("size, expected: 0, got: %d, see '%s'", fileInfo.Size(), file.Name())
+	}
+}
+
+func TestDrainCollapseSmall(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainCollapseSmall-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	// less than a filesystem block to collapse, nothing to do
+	for _, size := range []int{0, 100} {
+		err = file.Truncate(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteAt(bytes.Repeat([]byte{'x'}, size), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outputBuffer := new(bytes.Buffer)
+		result, err := Drain(context.Background(), file, outputBuffer, Options{EndAction: EndCollapse})
+		if err != nil || !result.Dumped || result.ByteCollapsed != 0 {
+			t.Errorf("size %d, expected dumped without collapse, got: %v dumped=%v collapsed=%d",
+				size, err, result.Dumped, result.ByteCollapsed)
+		}
+		if outputBuffer.Len() != size {
+			t.Errorf("size %d, output: %d bytes", size, outputBuffer.Len())
+		}
+	}
+}
+
+func TestDrainFollowTruncated(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainFollowTruncated-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(bytes.Repeat([]byte{'x'}, int(4*fsBlockSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// logrotate copytruncate, then the writer start again
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		file.Truncate(0)
+		file.WriteAt(bytes.Repeat([]byte{'y'}, int(2*fsBlockSize)), 0)
+	}()
+
+	options := Options{Follow: true, IdleTimeout: 5 * time.Second, EndAction: EndCollapse, Force: true}
+	result, err := Drain(context.Background(), file, new(bytes.Buffer), options)
+	if err != ErrFileTruncated || result.Dumped {
+		t.Fatalf("expected %v, got: %v dumped=%v", ErrFileTruncated, err, result.Dumped)
+	}
+
+	// the new bytes haven't been collapsed
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() != 2*fsBlockSize {
+		t.Errorf("size, expected: %d, got: %d, see '%s'", 2*fsBlockSize, fileInfo.Size(), file.Name())
+	}
+}
+
+// output appending bytes to a file (like another process) during the first write
+type appendingWriter struct {
+	bytes.Buffer
+	appender *os.File
+	appended []byte
+}
+
+func (writer *appendingWriter) Write(buffer []byte) (int, error) {
+	if writer.appended != nil {
+		_, err := writer.appender.Write(writer.appended)
+		if err != nil {
+			return 0, err
+		}
+		writer.appended = nil
+	}
+	return writer.Buffer.Write(buffer)
+}
+
+func TestDrainSnapshot(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainSnapshot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	// writer of file, in append mode
+	appender, err := os.OpenFile(file.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appender.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(4*fsBlockSize))
+	appendedContent := bytes.Repeat([]byte{'y'}, int(fsBlockSize))
+
+	testCases := []struct {
+		name      string
+		appended  []byte
+		expectedE error
+		expectedS int64 /* size of file at the end */
+	}{
+		{"unchanged", nil, nil, 0},
+		{"grown", appendedContent, ErrFileGrown, int64(len(testContent) + len(appendedContent))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err = file.Truncate(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = appender.Write(testContent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the appender is another opener of file
+			output := &appendingWriter{appender: appender, appended: tc.appended}
+			options := Options{BufferSize: fsBlockSize, Snapshot: true, EndAction: EndTruncate, Force: true}
+			result, err := Drain(context.Background(), file, output, options)
+			if err != tc.expectedE {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedE, err)
+			}
+			if result.SnapshotSize != int64(len(testContent)) {
+				t.Errorf("snapshot size, expected: %d, got: %d", len(testContent), result.SnapshotSize)
+			}
+			// the appended bytes aren't dumped
+			if !bytes.Equal(output.Bytes(), testContent) {
+				t.Errorf("output, expected %d bytes of the snapshot, got %d bytes", len(testContent), output.Len())
+			}
+
+			fileInfo, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Size() != tc.expectedS {
+				t.Errorf("size, expected: %d, got: %d, see '%s'", tc.expectedS, fileInfo.Size(), file.Name())
+			}
+			// the appended bytes are still in file
+			if tc.appended != nil {
+				fileEnd := make([]byte, len(tc.appended))
+				_, err = file.ReadAt(fileEnd, int64(len(testContent)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(fileEnd, tc.appended) {
+					t.Errorf("the bytes appended after the snapshot have been modified, see '%s'", file.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestDrainSafeTruncate(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainSafeTruncate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	// writer of file, in append mode
+	appender, err := os.OpenFile(file.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appender.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(4*fsBlockSize))
+	appendedContent := bytes.Repeat([]byte{'y'}, int(fsBlockSize))
+
+	testCases := []struct {
+		name           string
+		appended       []byte /* appended during the dump */
+		appendedAfter  []byte /* appended after the dump (AfterDump) */
+		flock          bool   /* the appender holds a flock on file */
+		expectedE      error
+		expectedOutput []byte
+	}{
+		{"unchanged",       nil,             nil,             false, nil,                testContent},
+		{"appended",        appendedContent, nil,             false, nil,                append(testContent, appendedContent...)},
+		{"appended after",  nil,             appendedContent, false, ErrTruncateRefused, testContent},
+		{"locked",          nil,             nil,             true,  ErrTruncateRefused, testContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err = file.Truncate(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = appender.Write(testContent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.flock {
+				err = unix.Flock(int(appender.Fd()), unix.LOCK_EX)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer unix.Flock(int(appender.Fd()), unix.LOCK_UN)
+			}
+
+			// the appender is another opener of file
+			output := &appendingWriter{appender: appender, appended: tc.appended}
+			options := Options{BufferSize: fsBlockSize, EndAction: EndTruncate, Force: true}
+			options.Hooks.AfterDump = func(Result) error {
+				_, err := appender.Write(tc.appendedAfter)
+				return err
+			}
+			result, err := Drain(context.Background(), file, output, options)
+			if err != tc.expectedE {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedE, err)
+			}
+			if !bytes.Equal(output.Bytes(), tc.expectedOutput) {
+				t.Errorf("output, expected %d bytes, got %d bytes", len(tc.expectedOutput), output.Len())
+			}
+			// the appender has file open, no lease
+			if tc.expectedE == nil && result.EndLock != "flock" {
+				t.Errorf("lock, expected: flock, got: %s", result.EndLock)
+			}
+
+			fileInfo, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedSize := int64(0)
+			if tc.expectedE != nil {
+				expectedSize = int64(len(tc.expectedOutput) + len(tc.appendedAfter))
+			}
+			if fileInfo.Size() != expectedSize {
+				t.Errorf("size, expected: %d, got: %d, see '%s'", expectedSize, fileInfo.Size(), file.Name())
+			}
+		})
+	}
+}
+
+func TestDrainStrategy(t *testing.T) {
+	capabilities, err := Probe(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainStrategy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(4*fsBlockSize+100))
+	testSize := int64(len(testContent))
+
+	// size of file after the collapse: the last block, or nothing with the rewrite
+	collapsedSize := int64(0)
+	if capabilities.Collapse {
+		collapsedSize = 100
+	}
+
+	testCases := []struct {
+		name      string
+		strategy  Strategy
+		endAction EndAction
+		expectedS int64     /* size of file at the end */
+		expectedE EndAction /* Result.EndAction */
+	}{
+		{"punch-hole",           StrategyPunchHole,  EndNone,     testSize,      EndNone},
+		{"punch-hole collapse",  StrategyPunchHole,  EndCollapse, collapsedSize, EndCollapse},
+		{"zero-range",           StrategyZeroRange,  EndNone,     testSize,      EndNone},
+		{"copy-rename",          StrategyCopyRename, EndNone,     0,             EndCollapse},
+		{"copy-rename collapse", StrategyCopyRename, EndCollapse, 0,             EndCollapse},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.strategy == StrategyZeroRange && !capabilities.ZeroRange {
+				t.Skip("the filesystem can't zero-range")
+			}
+
+			err = file.Truncate(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.WriteAt(testContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			outputBuffer := new(bytes.Buffer)
+			result, err := Drain(context.Background(), file, outputBuffer,
+				Options{BufferSize: fsBlockSize, Strategy: tc.strategy, EndAction: tc.endAction})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Strategy != tc.strategy || !bytes.Equal(testContent, outputBuffer.Bytes()) {
+				t.Errorf("strategy and output, expected: %v %d bytes, got: %v %d bytes",
+					tc.strategy, len(testContent), result.Strategy, outputBuffer.Len())
+			}
+			if result.EndAction != tc.expectedE {
+				t.Errorf("end action, expected: %v, got: %v", tc.expectedE, result.EndAction)
+			}
+
+			// file is still the one named file.Name(), even after a rewrite
+			fileInfo, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pathInfo, err := os.Stat(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(fileInfo, pathInfo) {
+				t.Errorf("file isn't %s anymore", file.Name())
+			}
+			if fileInfo.Size() != tc.expectedS || result.ByteCollapsed != testSize-tc.expectedS {
+				t.Errorf("size and collapsed, expected: %d %d, got: %d %d, see '%s'",
+					tc.expectedS, testSize-tc.expectedS, fileInfo.Size(), result.ByteCollapsed, file.Name())
+			}
+		})
+	}
+}
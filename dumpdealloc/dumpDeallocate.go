@@ -0,0 +1,733 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+/**
+ * Get the filesystem block size where file is located
+ *
+ * Can return: nil or *os.PathError
+ */
+func FilesystemBlockSize(file *os.File) (int64, error) {
+
+	var filesystemInfo unix.Statfs_t
+
+	err := unix.Fstatfs(int(file.Fd()), &filesystemInfo)
+	if err != nil {
+		return 0, &os.PathError{Op: "fstatfs", Path: file.Name(), Err: err}
+	}
+
+	return filesystemInfo.Bsize, nil
+}
+
+/**
+ * Copy file to output while deallocating file, chunk by chunk, starting at the
+ * current read offset of file (everything before is considered already
+ * deallocated), as set by options (see Options).
+ * A byte is only deallocated once written on output, durable if output is a
+ * DurableWriter. The punch-holes are aligned on filesystem blocks, the
+ * unaligned tail of a chunk is deallocated with the next one (or at the end
+ * of the dump), and checked to really free space (st_blocks).
+ * When output is a pipe, a socket or a file (*os.File or *FileOutput), the
+ * chunks are moved by the kernel (splice, sendfile or copy_file_range, see
+ * Result.ZeroCopy) instead of being copied in the buffer, which remains the
+ * fallback if the kernel can't. The last bytes moved to a pipe or a socket
+ * are only deallocated once read, if the reader goes away (or doesn't read
+ * them in time) they stay in file and a *WriteError is returned.
+ * Stop between two chunks when ctx is done (Result.Interrupted is set, unless
+ * options.Follow where it's the normal way to stop).
+ * At the end the read offset of file is right after the bytes written (at
+ * Result.SafeResumeOffset on error with options.InFlight).
+ *
+ * The counters of result are updated, even on error: the offset up to which
+ * file has been deallocated, the number of bytes written, the number of bytes
+ * really freed (whole filesystem blocks) and reclaimed (st_blocks), and the
+ * offset from which file can be dumped again without losing bytes.
+ *
+ * Can return: nil, *ReadError, *WriteError, *PunchError, *os.PathError,
+ * *CollapseError (Options.CollapseEvery), ErrNothingReclaimed
+ * (Options.RequireReclaim) or ErrFileTruncated (Options.Follow)
+ */
+func CopyWhileDeallocate(ctx context.Context, file *os.File, output io.Writer, options Options, result *Result) (err error) {
+	var fileTotalByteDeallocated, fileTotalByteRead, outputTotalByteWritten, fileTotalByteFreed, fileTotalByteCollapsed int64
+
+	// syscall used to write on output without buffer, see zeroCopier
+	var zeroCopyUsed string
+
+	// offset of file up to which we consider the dump safe,
+	// nothing after it has been deallocated
+	var fileSafeUpTo int64
+
+	fileTotalByteDeallocated, err = file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &os.PathError{Op: "seek", Path: file.Name(), Err: err}
+	}
+	result.StartOffset = fileTotalByteDeallocated
+
+	// end of the snapshot, it moves with the collapses
+	var snapshotEnd int64
+	if options.Snapshot {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		result.SnapshotSize = fileInfo.Size()
+		snapshotEnd = result.SnapshotSize
+	}
+	fileSafeUpTo = fileTotalByteDeallocated
+	result.SafeResumeOffset = fileSafeUpTo
+
+	reclaim, err := newReclaimTracker(file, options.RequireReclaim, options.Logger)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		result.ByteDeallocated = fileTotalByteDeallocated
+		result.ByteRead = fileTotalByteRead
+		result.ByteWritten = outputTotalByteWritten
+		result.ByteFreed = fileTotalByteFreed
+		result.ByteCollapsed = fileTotalByteCollapsed
+		result.SafeResumeOffset = fileSafeUpTo
+		result.ZeroCopy = zeroCopyUsed
+		result.ByteReclaimed = reclaim.byteReclaimed
+		result.BlocksStart, result.BlocksEnd = reclaim.blocksStart, reclaim.blocksLast
+	}()
+
+	// counters of the punch-holes for the progress, see punchQueue
+	var punched punchCounters
+	punched.set(0, 0, reclaim.blocksLast)
+
+	// punching less than a filesystem block only zeroes it, nothing is freed.
+	// So in the loop we only punch up to the last whole block dumped,
+	// the bytes between filePunchedUpTo and fileTotalByteDeallocated are
+	// dumped but still allocated.
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		return err
+	}
+	filePunchedUpTo := fileTotalByteDeallocated - fileTotalByteDeallocated%fsBlockSize
+	// with options.InFlight, the punch-holes queued may not be done yet
+	filePunchQueuedUpTo := filePunchedUpTo
+
+	// offset of file up to which the bytes written on output are durable
+	fileStart := fileTotalByteDeallocated
+	durableOutput, _ := output.(DurableWriter)
+	// when output is a file descriptor, the chunks don't go through buffer
+	copier := newZeroCopier(output)
+	fileDurableUpTo := func() int64 {
+		if copier != nil && durableOutput == nil {
+			// the pipe or socket may still reference the pages of the last bytes
+			return fileTotalByteDeallocated - copier.bytesInFlight()
+		}
+		if durableOutput == nil {
+			return fileTotalByteDeallocated
+		}
+		return fileStart - fileTotalByteCollapsed + durableOutput.Durable()
+	}
+
+	collapseEvery := options.CollapseEvery
+	if options.Checkpoint != nil {
+		// a crash between the collapse and the update of the state would
+		// make the next run skip bytes
+		collapseEvery = 0
+	}
+
+	// the byte rate limit can be changed by the control socket
+	byteLimiter := &rateLimiter{}
+	if options.Control != nil {
+		byteLimiter = &options.Control.limiter
+	}
+	if options.Rate > 0 {
+		byteLimiter.SetRate(options.Rate)
+	}
+	opsLimiter := &rateLimiter{}
+	opsLimiter.SetRate(options.MaxOps)
+
+	// deallocate file from filePunchedUpTo to end
+	punchUpTo := func(end int64) error {
+		if options.Strategy == StrategyCopyRename {
+			// the dumped bytes are removed at the end (see Drain)
+			filePunchedUpTo = end
+			return nil
+		}
+		err := reclaim.BeforePunch()
+		if err != nil {
+			return err
+		}
+		opsLimiter.Wait(ctx, 1)
+		byteFreed, err := deallocate(file, options.Strategy, filePunchedUpTo, end, fsBlockSize)
+		if err != nil {
+			return err
+		}
+		fileTotalByteFreed += byteFreed
+		filePunchedUpTo = end
+		err = reclaim.AfterPunch(byteFreed)
+		punched.set(fileTotalByteFreed, reclaim.byteReclaimed, reclaim.blocksLast)
+		return err
+	}
+
+	bufferSize := options.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	// read-ahead and punch-holes in goroutines (see readAhead and punchQueue)
+	var ahead *readAhead
+	var puncher *punchQueue
+	if options.InFlight > 1 && collapseEvery == 0 {
+		limit := int64(-1)
+		if options.Snapshot {
+			limit = snapshotEnd
+		}
+		ahead = newReadAhead(file, fileTotalByteDeallocated, limit, options.InFlight, bufferSize)
+		defer func() {
+			// the read offset is after the chunks read ahead, which aren't
+			// dumped: move it back to where the dump can resume
+			ahead.stop()
+			_, seekErr := file.Seek(fileSafeUpTo, io.SeekStart)
+			if seekErr != nil && err == nil {
+				err = &os.PathError{Op: "seek", Path: file.Name(), Err: seekErr}
+			}
+		}()
+		puncher = newPunchQueue(options.InFlight, punchUpTo)
+		// the result read the counters of punchUpTo, the goroutine must be done
+		defer puncher.wait()
+		// the buffers of ahead are the ones written
+		copier = nil
+		bufferSize = 0
+	}
+	buffer := make([]byte, bufferSize)
+
+	var watcher *fileWatcher
+	if options.Follow {
+		watcher = newFileWatcher(file)
+		defer watcher.Close()
+	}
+
+	// main read→write loop
+	for {
+
+		if options.Control != nil {
+			options.Control.beforeChunk(ctx)
+		}
+
+		// stopped (or follow stopped), the previous chunk is written and
+		// deallocated, we don't start a new one
+		if ctx.Err() != nil {
+			result.Interrupted = !options.Follow
+			break
+		}
+
+		readBuffer := buffer
+		if options.Snapshot {
+			remaining := snapshotEnd - fileTotalByteDeallocated
+			if remaining <= 0 {
+				break
+			}
+			if remaining < int64(len(readBuffer)) {
+				readBuffer = readBuffer[:remaining]
+			}
+		}
+
+		var nbByteRead, nbByteWritten int
+		var readError, writeError error
+		var chunk []byte
+		copied := false
+		if copier != nil && copier.usable() {
+			// the chunk is on output as soon as it is read
+			if options.Checkpoint != nil {
+				err = options.Checkpoint.Pending(fileTotalByteDeallocated + int64(len(readBuffer)))
+				if err != nil {
+					return err
+				}
+			}
+			nbByteRead, writeError = copier.copyChunk(file, len(readBuffer))
+			if options.Checkpoint != nil && nbByteRead < len(readBuffer) {
+				// less moved (nothing at the end of file), only these may be on output
+				err = options.Checkpoint.Pending(fileTotalByteDeallocated + int64(nbByteRead))
+				if err != nil {
+					return err
+				}
+			}
+			if writeError == errorZeroCopy {
+				// nothing moved, the chunk goes through buffer from now on
+				writeError = nil
+			} else {
+				copied = true
+				zeroCopyUsed = copier.used
+				nbByteWritten = nbByteRead
+				if nbByteRead == 0 && writeError == nil {
+					readError = io.EOF
+				}
+			}
+		}
+		if ahead != nil {
+			// read while the previous chunks were written
+			chunk, readError = ahead.next()
+			nbByteRead = len(chunk)
+		} else if !copied {
+			nbByteRead, readError = file.Read(readBuffer)
+			chunk = readBuffer[:nbByteRead]
+		}
+		fileTotalByteRead += int64(nbByteRead)
+
+		if nbByteRead > 0 {
+
+			if !copied {
+				if options.Checkpoint != nil {
+					err = options.Checkpoint.Pending(fileTotalByteDeallocated + int64(nbByteRead))
+					if err != nil {
+						return err
+					}
+				}
+
+				// write on output the bytes we just read in file
+				nbByteWritten, writeError = output.Write(chunk)
+			}
+			outputTotalByteWritten += int64(nbByteWritten)
+
+			// fail to write as much byte as we read
+			if writeError == nil && nbByteRead != nbByteWritten {
+				writeError = io.ErrShortWrite
+			}
+			if writeError != nil {
+				return &WriteError{
+					Offset:       fileTotalByteDeallocated,
+					ByteToWrite:  int64(nbByteRead),
+					ByteWritten:  int64(nbByteWritten),
+					TotalWritten: outputTotalByteWritten,
+					Err:          writeError,
+				}
+			}
+
+			fileTotalByteDeallocated += int64(nbByteRead)
+
+			// the last PunchLag bytes written are kept
+			safeUpTo := fileDurableUpTo()
+			if safeUpTo > fileTotalByteDeallocated-options.PunchLag {
+				safeUpTo = fileTotalByteDeallocated - options.PunchLag
+			}
+			if safeUpTo > fileSafeUpTo {
+				fileSafeUpTo = safeUpTo
+			}
+
+			// the bytes are on output, if we crash before the punch-hole
+			// the next run will resume after them (see DeallocateUpTo)
+			if options.Checkpoint != nil {
+				err = options.Checkpoint.Commit(fileSafeUpTo)
+				if err != nil {
+					return err
+				}
+			}
+
+			// deallocate the safe bytes from file, up to the last whole
+			// filesystem block, the tail is carried over to the next chunk
+			punchEnd := fileSafeUpTo - fileSafeUpTo%fsBlockSize
+			if punchEnd > filePunchQueuedUpTo {
+				if puncher != nil {
+					err = puncher.queue(punchEnd)
+				} else {
+					err = punchUpTo(punchEnd)
+				}
+				if err != nil {
+					return err
+				}
+				filePunchQueuedUpTo = punchEnd
+			}
+
+			/* I can't use FALLOC_FL_COLLAPSE_RANGE (I tried) because
+			*  the file read-seek-pointer isn't modified by fallocate :
+			*    file : ' ← x already read bytes → read-seek-pointer ← unread bytes → '
+			*    fallocate COLLAPSE_RANGE (x bytes are remove from the start of the file)
+			*    file should be : ' read-seek-pointer (file start) ← unread bytes → '
+			*    file is        : ' ← x unread bytes → read-seek-pointer ← unread bytes → '
+			*  Also we can't fix the issue by moving the seek pointer because the file can be open
+			*  by other process. On some conditions if this other process write on the file,
+			*  the x bytes removed by fallocate are added back by the kernel (as zeros, sparse).
+			*  So we only collapse (options.CollapseEvery) when we are the only process having
+			*  the file open, and move our seek pointer ourselves.
+			 */
+			if collapseEvery > 0 && filePunchedUpTo >= collapseEvery {
+				collapsed, err := collapseIfExclusive(file, filePunchedUpTo, options.Exclusive)
+				if errors.Is(err, unix.EOPNOTSUPP) {
+					logPrintf(options.Logger, "warning: the filesystem of %s can't collapse, periodic collapse disabled", file.Name())
+					collapseEvery = 0
+				} else if err != nil {
+					return err
+				}
+				if collapsed {
+					// the punched bytes are the start of file, nothing remain of them
+					fileTotalByteCollapsed += filePunchedUpTo
+					fileTotalByteDeallocated -= filePunchedUpTo
+					fileSafeUpTo -= filePunchedUpTo
+					snapshotEnd -= filePunchedUpTo
+					filePunchedUpTo, filePunchQueuedUpTo = 0, 0
+					_, err = file.Seek(fileTotalByteDeallocated, io.SeekStart)
+					if err != nil {
+						return &os.PathError{Op: "seek", Path: file.Name(), Err: err}
+					}
+				}
+			}
+
+			byteFreed, byteReclaimed, blocksLast := punched.get()
+			progress := Result{
+				StartOffset:      fileStart,
+				ByteDeallocated:  fileTotalByteDeallocated,
+				ByteRead:         fileTotalByteRead,
+				ByteWritten:      outputTotalByteWritten,
+				ByteFreed:        byteFreed,
+				ByteCollapsed:    fileTotalByteCollapsed,
+				ByteReclaimed:    byteReclaimed,
+				BlocksStart:      reclaim.blocksStart,
+				BlocksEnd:        blocksLast,
+				SafeResumeOffset: fileSafeUpTo,
+			}
+			if options.Hooks.AfterChunk != nil {
+				options.Hooks.AfterChunk(progress)
+			}
+			if options.Control != nil {
+				options.Control.afterChunk(progress)
+			}
+			byteLimiter.Wait(ctx, int64(nbByteRead))
+		}
+
+		if readError == io.EOF {
+			// the whole file has been read (and deallocated)
+			// in follow mode we wait for more, otherwise we stop here
+			if options.Follow {
+				dataAvailable, err := watcher.WaitForData(ctx, fileTotalByteDeallocated, options.IdleTimeout)
+				if err != nil {
+					return err
+				}
+				if dataAvailable {
+					continue
+				}
+			}
+			// bytes appended before the end action took its lock
+			if options.atEOF != nil {
+				more, err := options.atEOF(fileTotalByteDeallocated)
+				if err != nil {
+					return err
+				}
+				if more {
+					continue
+				}
+			}
+			break
+		}
+
+		// the zero-copy syscall failed before moving anything
+		if writeError != nil {
+			return &WriteError{
+				Offset:       fileTotalByteDeallocated,
+				ByteToWrite:  int64(len(readBuffer)),
+				TotalWritten: outputTotalByteWritten,
+				Err:          writeError,
+			}
+		}
+		if readError != nil {
+			return &ReadError{Offset: fileTotalByteDeallocated, Err: readError}
+		}
+	}
+
+	if ahead != nil {
+		// nothing more to read (the read offset is restored at the end)
+		ahead.stop()
+	}
+
+	// make everything written durable, and release the PunchLag window
+	if durableOutput != nil {
+		err = durableOutput.Flush()
+		if err != nil {
+			return &WriteError{Offset: fileTotalByteDeallocated, TotalWritten: outputTotalByteWritten, Err: err}
+		}
+	}
+	if copier != nil {
+		// with Follow, ctx done is the normal end: wait for the reader
+		drainCtx := ctx
+		if options.Follow {
+			drainCtx = context.Background()
+		}
+		inFlight, err := copier.drain(drainCtx)
+		if err != nil {
+			// the bytes still in the output may never be read, they stay in file
+			if fileTotalByteDeallocated-inFlight > fileSafeUpTo {
+				fileSafeUpTo = fileTotalByteDeallocated - inFlight
+			}
+			if err == ctx.Err() {
+				result.Interrupted = true
+				return err
+			}
+			return &WriteError{Offset: fileTotalByteDeallocated, TotalWritten: outputTotalByteWritten, Err: err}
+		}
+	}
+	if puncher != nil {
+		err = puncher.wait()
+		if err != nil {
+			return err
+		}
+	}
+	fileSafeUpTo = fileTotalByteDeallocated
+	if options.Checkpoint != nil {
+		err = options.Checkpoint.Commit(fileSafeUpTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	// deallocate the carried over tail (only zeroed, unless it's a whole block)
+	if fileTotalByteDeallocated > filePunchedUpTo {
+		err = punchUpTo(fileTotalByteDeallocated)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = reclaim.Blocks()
+	return err
+}
+
+/**
+ * Deallocate (fallocate punch-hole) the bytes of file between start and end.
+ * Return the number of bytes really freed: the kernel free the whole filesystem
+ * blocks inside [start, end) but only zeroes the partial ones.
+ *
+ * Can return: nil or *PunchError
+ */
+func PunchHole(file *os.File, start int64, end int64, fsBlockSize int64) (byteFreed int64, err error) {
+
+	/* man 2 fallocate:
+	*  The FALLOC_FL_PUNCH_HOLE flag must be ORed with FALLOC_FL_KEEP_SIZE in mode
+	 */
+	err = unix.Fallocate(int(file.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		start,
+		end-start)
+	if err != nil {
+		return 0, &PunchError{Start: start, End: end, Err: err}
+	}
+
+	// first and last whole blocks inside [start, end)
+	firstWholeBlock := (start + fsBlockSize - 1) / fsBlockSize * fsBlockSize
+	lastWholeBlockEnd := end - end%fsBlockSize
+	if lastWholeBlockEnd <= firstWholeBlock {
+		return 0, nil
+	}
+	return lastWholeBlockEnd - firstWholeBlock, nil
+}
+
+/**
+ * Move the read offset of file to the first data byte after the current read
+ * offset (lseek SEEK_DATA), so we don't dump as zeros the hole left by the
+ * punch-holes of a previous interrupted run.
+ * If there is no data after the current read offset, move it to the end of file.
+ * Return the new read offset.
+ *
+ * The hole is block aligned: the leading zeros of the first data block are
+ * skipped too, they are the partial block zeroed at the end of a previous run
+ * (use Options.DumpLeadingHole to dump them).
+ *
+ * Can return: nil or *os.PathError
+ */
+func SkipHole(file *os.File) (offset int64, err error) {
+
+	offset, err = file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, &os.PathError{Op: "seek", Path: file.Name(), Err: err}
+	}
+
+	dataOffset, err := unix.Seek(int(file.Fd()), offset, unix.SEEK_DATA)
+
+	switch {
+	case err == unix.ENXIO:
+		// only hole after offset
+		dataOffset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return offset, &os.PathError{Op: "seek", Path: file.Name(), Err: err}
+		}
+	case err == unix.EINVAL:
+		// SEEK_DATA not supported, we can't skip anything
+		return offset, nil
+	case err != nil:
+		return offset, &os.PathError{Op: "seek data", Path: file.Name(), Err: err}
+	}
+
+	// skip the zeroed bytes of the partially punched block
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		return dataOffset, err
+	}
+	if fsBlockSize <= 0 {
+		return dataOffset, nil
+	}
+	block := make([]byte, fsBlockSize-dataOffset%fsBlockSize)
+	nbByteRead, err := file.ReadAt(block, dataOffset)
+	if err != nil && err != io.EOF {
+		return dataOffset, err
+	}
+	zeros := 0
+	for zeros < nbByteRead && block[zeros] == 0 {
+		zeros++
+	}
+	if zeros == 0 {
+		return dataOffset, nil
+	}
+
+	dataOffset, err = file.Seek(dataOffset+int64(zeros), io.SeekStart)
+	if err != nil {
+		return offset, &os.PathError{Op: "seek", Path: file.Name(), Err: err}
+	}
+
+	return dataOffset, nil
+}
+
+/**
+ * Deallocate (fallocate punch-hole) file from its start to offset.
+ * Used when resuming a dump (Options.Checkpoint): the previous run may have stopped
+ * between the write on output and the punch-hole.
+ *
+ * Can return: nil or *PunchError
+ */
+func DeallocateUpTo(file *os.File, offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+
+	err := unix.Fallocate(int(file.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		0,
+		offset)
+	if err != nil {
+		return &PunchError{Start: 0, End: offset, Err: err}
+	}
+	return nil
+}
+
+/**
+ * Collapse (fallocate collapse-range) the first length bytes of file (a
+ * multiple of the filesystem block size) if no other process has file open:
+ * exclusive (promised by the caller) or a write lease can be taken.
+ * Return false if file is open elsewhere, or if length reach the end of file.
+ *
+ * Can return: nil, *os.PathError or *CollapseError
+ */
+func collapseIfExclusive(file *os.File, length int64, exclusive bool) (collapsed bool, err error) {
+	if !exclusive {
+		// a lease we already hold (see safeTruncater) is kept
+		lease, err := unix.FcntlInt(file.Fd(), unix.F_GETLEASE, 0)
+		if err != nil || lease != unix.F_WRLCK {
+			_, err = unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_WRLCK)
+			if err != nil {
+				return false, nil
+			}
+			defer unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_UNLCK)
+		}
+	}
+
+	// fallocate can't collapse the whole file
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if length >= fileInfo.Size() {
+		return false, nil
+	}
+
+	err = unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_COLLAPSE_RANGE, 0, length)
+	if err != nil {
+		return false, &CollapseError{Length: length, Err: err}
+	}
+	return true, nil
+}
+
+/**
+ * Collapse (man 2 fallocate) file of the maximum number of byte possible less than bytesToDeallocate.
+ * For exemple if file is 2 filesystem block (fsb), and you try to deallocate more bytes, the function will
+ * deallocate 1 filesystem block (fallocate can't collapse the whole file).
+ *
+ * Can return errors: nil, errorZero, errorLessThanOneFsb, *os.PathError and
+ * *CollapseError (unix.EOPNOTSUPP if the filesystem can't collapse).
+ */
+func CollapseFileStart(file *os.File, bytesToDeallocate int64) (byteActualyDeallocated int64, err error) {
+
+	// fsb : file system block
+
+	if bytesToDeallocate <= 0 {
+		return 0, errorZero
+	}
+
+	// for COLLAPSE_RANGE, offset and len have to
+	// be multiple of the filesystem block size
+	// so we get filesystem informations (including block size)
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		return 0, err
+	}
+
+	// get number of fsb in the file
+	var fileInfo unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfo)
+	if err != nil {
+		return 0, &os.PathError{Op: "fstat", Path: file.Name(), Err: err}
+	}
+
+	// the size, not st_blocks: once dumped, file is mostly holes
+	fileSizeInFsb := (fileInfo.Size + fsBlockSize - 1) / fsBlockSize
+
+	if fileSizeInFsb == 1 {
+		return 0, errorLessThanOneFsb
+	}
+
+	// we make sure collapseLen is a multiple of the filesystem block size
+	collapseLen := bytesToDeallocate - (bytesToDeallocate % fsBlockSize)
+	collapseLenInFsb := collapseLen / fsBlockSize
+
+	// we can't deallocate the whole file
+	if collapseLenInFsb >= fileSizeInFsb {
+		collapseLen -= fsBlockSize
+		collapseLenInFsb -= 1
+	}
+
+	if collapseLenInFsb < 1 {
+		return 0, errorZero
+	}
+
+	// collapse (erase) the greatest number of filesystem blocks already dumped/read
+	err = unix.Fallocate(int(file.Fd()),
+		unix.FALLOC_FL_COLLAPSE_RANGE,
+		0,
+		collapseLen)
+	if err != nil {
+		return 0, &CollapseError{Length: collapseLen, Err: err}
+	}
+
+	return collapseLen, nil
+}
+
+var errorZero = errors.New("try to deallocate 0 or less bytes")
+var errorLessThanOneFsb = errors.New("can't collapse the file to less than one file system block")
@@ -0,0 +1,937 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFilesystemBlockSize(t *testing.T) {
+	// create the test file
+	file, err := os.Open("../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	filesystemBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filesystemBlockSize <= 0 {
+		t.Errorf("invalide filesystem block size returned : '%v'", filesystemBlockSize)
+	}
+}
+
+func TestCopyWhileDeallocate(t *testing.T) {
+	// get content from LICENSE file
+	testContent, err := ioutil.ReadFile("../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create the test file
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep the file if the test fail
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	// write the test content (LICENSE) on the test file
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sync (just to be sure)
+	err = file.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seek to the begining of the file
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// get file stats before the CopyWhileDeallocate
+	var fileInfoBefore unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfoBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// buffer should be feed with the content of file (LICENSE)
+	// and file should be deallocated
+	outputBuffer := new(bytes.Buffer)
+	err = CopyWhileDeallocate(context.Background(), file, outputBuffer, Options{}, new(Result))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check if buffer has been feed with content of file (LICENSE)
+	if !bytes.Equal(testContent, outputBuffer.Bytes()) {
+		t.Errorf("content hasn't been copied correctly, see '%s'", file.Name())
+	}
+
+	// check if file now only contain \0
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileNewContent []byte
+	fileNewContent, err = ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(fileNewContent, []byte{0}) != len(fileNewContent) {
+		t.Errorf("file should only contain \\0, see '%s'", file.Name())
+	}
+
+	// get file stats after the CopyWhileDeallocate
+	var fileInfoAfter unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfoAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check if file has been deallocated
+	if fileInfoBefore.Size != fileInfoAfter.Size {
+		t.Errorf("file size, expected: '%v', got '%v', see '%s'", fileInfoBefore.Size, fileInfoAfter.Size, file.Name())
+	}
+	if fileInfoBefore.Blocks <= fileInfoAfter.Blocks {
+		t.Errorf("file blocks, expected: < '%v', got '%v', see '%s'", fileInfoBefore.Blocks, fileInfoAfter.Blocks, file.Name())
+	}
+}
+
+func TestCopyWhileDeallocateBlockAligned(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateBlockAligned-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 8 filesystem blocks and a half, dumped with a buffer which isn't a
+	// multiple of the filesystem block size
+	testContent := bytes.Repeat([]byte{'x'}, int(8*fsBlockSize+fsBlockSize/2))
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := Options{BufferSize: fsBlockSize/3 + 1}
+
+	outputBuffer := new(bytes.Buffer)
+	var result Result
+	err = CopyWhileDeallocate(context.Background(), file, outputBuffer, options, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileTotalByteDeallocated, fileTotalByteFreed := result.ByteDeallocated, result.ByteFreed
+
+	if !bytes.Equal(testContent, outputBuffer.Bytes()) {
+		t.Errorf("content hasn't been copied correctly, see '%s'", file.Name())
+	}
+	if fileTotalByteDeallocated != int64(len(testContent)) {
+		t.Errorf("deallocated, expected: '%v', got '%v'", len(testContent), fileTotalByteDeallocated)
+	}
+	if fileTotalByteFreed != 8*fsBlockSize {
+		t.Errorf("freed, expected: '%v', got '%v'", 8*fsBlockSize, fileTotalByteFreed)
+	}
+
+	// only the last partial block should remain allocated
+	var fileInfo unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Blocks*512 > fsBlockSize {
+		t.Errorf("allocated bytes, expected: <= '%v', got '%v', see '%s'", fsBlockSize, fileInfo.Blocks*512, file.Name())
+	}
+}
+
+// writer failing once limit bytes have been written
+type failingWriter struct {
+	written int
+	limit   int
+}
+
+func (writer *failingWriter) Write(buffer []byte) (int, error) {
+	if writer.written+len(buffer) > writer.limit {
+		return 0, io.ErrClosedPipe
+	}
+	writer.written += len(buffer)
+	return len(buffer), nil
+}
+
+func TestCopyWhileDeallocatePunchLag(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocatePunchLag-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(8*fsBlockSize))
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := Options{BufferSize: fsBlockSize, PunchLag: 2 * fsBlockSize}
+
+	// the output fail after 5 blocks, the last 2 must still be in file
+	var result Result
+	err = CopyWhileDeallocate(context.Background(), file, &failingWriter{limit: int(5 * fsBlockSize)}, options, &result)
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected a WriteError of %v, got: %v", io.ErrClosedPipe, err)
+	}
+	if writeErr.Offset != 5*fsBlockSize || writeErr.ByteWritten != 0 {
+		t.Errorf("WriteError, expected: offset %d written 0, got: offset %d written %d",
+			5*fsBlockSize, writeErr.Offset, writeErr.ByteWritten)
+	}
+	// the chunk which failed to be written has been read
+	if result.ByteRead != 6*fsBlockSize {
+		t.Errorf("read, expected: %d, got: %d", 6*fsBlockSize, result.ByteRead)
+	}
+
+	fileContent := make([]byte, len(testContent))
+	_, err = file.ReadAt(fileContent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	safeResumeOffset := 3 * fsBlockSize
+	if result.SafeResumeOffset != safeResumeOffset {
+		t.Errorf("safe resume offset, expected: %d, got: %d", safeResumeOffset, result.SafeResumeOffset)
+	}
+	if bytes.Count(fileContent[:safeResumeOffset], []byte{0}) != int(safeResumeOffset) {
+		t.Errorf("file should only contain \\0 before %d, see '%s'", safeResumeOffset, file.Name())
+	}
+	if !bytes.Equal(fileContent[safeResumeOffset:], testContent[safeResumeOffset:]) {
+		t.Errorf("file should be untouched after %d, see '%s'", safeResumeOffset, file.Name())
+	}
+}
+
+func TestCopyWhileDeallocateRate(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateRate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(8*fsBlockSize))
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		options Options
+	}{
+		// 8 chunks at 16 chunks per second
+		{"rate", Options{BufferSize: fsBlockSize, Rate: 16 * fsBlockSize}},
+		// 8 punch-holes at 16 per second
+		{"max-ops", Options{BufferSize: fsBlockSize, MaxOps: 16}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = file.WriteAt(testContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var output bytes.Buffer
+			var result Result
+			start := time.Now()
+			err = CopyWhileDeallocate(context.Background(), file, &output, tc.options, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+				t.Errorf("dump not throttled, took %v", elapsed)
+			}
+			if !bytes.Equal(output.Bytes(), testContent) {
+				t.Errorf("output differ from the file content")
+			}
+		})
+	}
+}
+
+// Return what has been appended to "previous dump\n" in path
+func appended(t *testing.T, path string) []byte {
+	content, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(content, []byte("previous dump\n")) {
+		t.Errorf("the previous content of %s has been overwritten", path)
+		return nil
+	}
+	return content[len("previous dump\n"):]
+}
+
+func TestCopyWhileDeallocateZeroCopy(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateZeroCopy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(8*fsBlockSize+100))
+
+	outputPath := file.Name() + "-output"
+	defer os.Remove(outputPath)
+
+	// each case return the output and a function returning what has been written on it
+	testCases := []struct {
+		name      string
+		output    func() (io.Writer, func() []byte)
+		zeroCopy  bool
+	}{
+		{"regular file", func() (io.Writer, func() []byte) {
+			output, err := os.Create(outputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return output, func() []byte { output.Close(); content, _ := ioutil.ReadFile(outputPath); return content }
+		}, true},
+		{"appended file", func() (io.Writer, func() []byte) {
+			err := ioutil.WriteFile(outputPath, []byte("previous dump\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return output, func() []byte { output.Close(); return appended(t, outputPath) }
+		}, false},
+		{"appended file output", func() (io.Writer, func() []byte) {
+			err := ioutil.WriteFile(outputPath, []byte("previous dump\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := OpenFileOutput(outputPath, true, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return output, func() []byte { output.Close(); return appended(t, outputPath) }
+		}, false},
+		{"file output", func() (io.Writer, func() []byte) {
+			os.Remove(outputPath)
+			output, err := OpenFileOutput(outputPath, false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return output, func() []byte { output.Close(); content, _ := ioutil.ReadFile(outputPath); return content }
+		}, true},
+		{"pipe", func() (io.Writer, func() []byte) {
+			reader, writer, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := make(chan []byte)
+			go func() { content, _ := ioutil.ReadAll(reader); reader.Close(); received <- content }()
+			return writer, func() []byte { writer.Close(); return <-received }
+		}, true},
+		{"buffer", func() (io.Writer, func() []byte) {
+			output := new(bytes.Buffer)
+			return output, output.Bytes
+		}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = file.WriteAt(testContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, written := tc.output()
+			var result Result
+			err = CopyWhileDeallocate(context.Background(), file, output, Options{BufferSize: 2 * fsBlockSize}, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written(), testContent) {
+				t.Errorf("output differ from the file content")
+			}
+			if (len(result.ZeroCopy) != 0) != tc.zeroCopy {
+				t.Errorf("zero-copy expected: %v, got: %q", tc.zeroCopy, result.ZeroCopy)
+			}
+			if result.ByteWritten != int64(len(testContent)) || result.ByteFreed != 8*fsBlockSize {
+				t.Errorf("written and freed, expected: %d %d, got: %d %d",
+					len(testContent), 8*fsBlockSize, result.ByteWritten, result.ByteFreed)
+			}
+		})
+	}
+}
+
+func TestCopyWhileDeallocateZeroCopyUnread(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateZeroCopyUnread-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fit in the pipe
+	testContent := bytes.Repeat([]byte{'x'}, int(2*fsBlockSize+100))
+
+	// the reader never read the pipe: it exits, or we are stopped meanwhile
+	testCases := []struct {
+		name      string
+		closeRead bool
+		expectedE error
+	}{
+		{"reader gone", true,  unix.EPIPE},
+		{"canceled",    false, context.Canceled},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = file.WriteAt(testContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, writer, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer writer.Close()
+			defer reader.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				if tc.closeRead {
+					reader.Close()
+				} else {
+					cancel()
+				}
+			}()
+
+			var result Result
+			err = CopyWhileDeallocate(ctx, file, writer, Options{BufferSize: fsBlockSize}, &result)
+			if !errors.Is(err, tc.expectedE) {
+				t.Fatalf("expected error %v, got: %v", tc.expectedE, err)
+			}
+			if result.Interrupted != !tc.closeRead {
+				t.Errorf("interrupted, expected: %v, got: %v", !tc.closeRead, result.Interrupted)
+			}
+
+			// nothing has been read, nothing is deallocated
+			if result.SafeResumeOffset != 0 || result.ByteFreed != 0 {
+				t.Errorf("resume offset and freed, expected: 0 0, got: %d %d", result.SafeResumeOffset, result.ByteFreed)
+			}
+			content := make([]byte, len(testContent))
+			_, err = file.ReadAt(content, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, testContent) {
+				t.Errorf("file content changed, see '%s'", file.Name())
+			}
+		})
+	}
+}
+
+// writer checking that nothing after the bytes it already wrote is deallocated in file
+type punchCheckingWriter struct {
+	file    *os.File /* file dumped, opened again (SEEK_DATA moves the offset) */
+	written int64
+	limit   int64 /* fail once limit bytes have been written */
+	early   int64 /* first data offset of file after the bytes written, if any */
+}
+
+func (writer *punchCheckingWriter) Write(buffer []byte) (int, error) {
+	firstData, err := unix.Seek(int(writer.file.Fd()), 0, unix.SEEK_DATA)
+	if err == nil && firstData > writer.written && writer.early == 0 {
+		writer.early = firstData
+	}
+	if writer.written+int64(len(buffer)) > writer.limit {
+		return 0, io.ErrClosedPipe
+	}
+	// let the reader go ahead
+	time.Sleep(time.Millisecond)
+	writer.written += int64(len(buffer))
+	return len(buffer), nil
+}
+
+func TestCopyWhileDeallocateInFlight(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateInFlight-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := make([]byte, 16*fsBlockSize+100)
+	for i := range testContent {
+		testContent[i] = byte('a' + i%26)
+	}
+
+	testCases := []struct {
+		name      string
+		inFlight  int
+		limit     int64
+		expectedE error
+	}{
+		{"one chunk",            1, int64(len(testContent)), nil},
+		{"4 chunks",             4, int64(len(testContent)), nil},
+		{"4 chunks, write error", 4, 5 * fsBlockSize,         io.ErrClosedPipe},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = file.WriteAt(testContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile, err := os.Open(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer checkFile.Close()
+
+			output := &punchCheckingWriter{file: checkFile, limit: tc.limit}
+			options := Options{BufferSize: fsBlockSize, InFlight: tc.inFlight}
+			var result Result
+			err = CopyWhileDeallocate(context.Background(), file, output, options, &result)
+			if !errors.Is(err, tc.expectedE) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedE, err)
+			}
+			if output.early != 0 {
+				t.Errorf("deallocated up to %d before being written", output.early)
+			}
+			if result.ByteWritten != tc.limit || result.SafeResumeOffset != tc.limit {
+				t.Errorf("written and safe resume offset, expected: %d, got: %d %d",
+					tc.limit, result.ByteWritten, result.SafeResumeOffset)
+			}
+
+			fileContent := make([]byte, len(testContent))
+			_, err = file.ReadAt(fileContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fileContent[tc.limit:], testContent[tc.limit:]) {
+				t.Errorf("file should be untouched after %d, see '%s'", tc.limit, file.Name())
+			}
+			// the chunks read ahead are given back, even on error
+			offset, _ := file.Seek(0, io.SeekCurrent)
+			if offset != result.SafeResumeOffset {
+				t.Errorf("read offset, expected: %d, got: %d", result.SafeResumeOffset, offset)
+			}
+			if tc.expectedE != nil {
+				return
+			}
+
+			if result.ByteFreed != 16*fsBlockSize || result.ByteDeallocated != result.SafeResumeOffset {
+				t.Errorf("freed and deallocated, expected: %d %d, got: %d %d",
+					16*fsBlockSize, result.SafeResumeOffset, result.ByteFreed, result.ByteDeallocated)
+			}
+		})
+	}
+}
+
+func TestCopyWhileDeallocateCollapseEvery(t *testing.T) {
+	capabilities, err := Probe(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !capabilities.Collapse {
+		t.Skip("collapse not supported")
+	}
+
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateCollapseEvery-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := make([]byte, 16*fsBlockSize)
+	for i := range testContent {
+		testContent[i] = byte('a' + i%26)
+	}
+
+	testCases := []struct {
+		name              string
+		otherOpener       bool
+		exclusive         bool
+		expectedCollapsed int64
+	}{
+		// collapse after the chunks 4, 8 and 12, not after 16 (whole file)
+		{"lease",              false, false, 12 * fsBlockSize},
+		{"other opener",       true,  false, 0},
+		{"other opener, exclusive", true, true, 12 * fsBlockSize},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err = file.Truncate(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.WriteAt(testContent, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.otherOpener {
+				other, err := os.Open(file.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer other.Close()
+			}
+
+			options := Options{BufferSize: fsBlockSize, CollapseEvery: 4 * fsBlockSize, Exclusive: tc.exclusive}
+			outputBuffer := new(bytes.Buffer)
+			var result Result
+			err = CopyWhileDeallocate(context.Background(), file, outputBuffer, options, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(outputBuffer.Bytes(), testContent) {
+				t.Errorf("output differ from the file content")
+			}
+			if result.ByteCollapsed != tc.expectedCollapsed {
+				t.Errorf("collapsed, expected: %d, got: %d", tc.expectedCollapsed, result.ByteCollapsed)
+			}
+			// the offsets are the ones of the collapsed file
+			expectedSize := int64(len(testContent)) - tc.expectedCollapsed
+			if result.ByteDeallocated != expectedSize || result.SafeResumeOffset != expectedSize {
+				t.Errorf("offsets, expected: %d, got: deallocated %d safe resume %d",
+					expectedSize, result.ByteDeallocated, result.SafeResumeOffset)
+			}
+			fileInfo, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Size() != expectedSize {
+				t.Errorf("size, expected: %d, got: %d, see '%s'", expectedSize, fileInfo.Size(), file.Name())
+			}
+		})
+	}
+}
+
+func TestPunchHole(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestPunchHole-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(make([]byte, 4*fsBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		start     int64
+		end       int64
+		expectedV int64
+	}{
+		{"partial", 1, fsBlockSize - 1, 0},
+		{"1fsb", 0, fsBlockSize, fsBlockSize},
+		{"unaligned 2fsb", 1, 3 * fsBlockSize, 2 * fsBlockSize},
+		{"unaligned both", fsBlockSize / 2, 3*fsBlockSize + fsBlockSize/2, 2 * fsBlockSize},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			byteFreed, err := PunchHole(file, tc.start, tc.end, fsBlockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if byteFreed != tc.expectedV {
+				t.Errorf("expected: %d, got: %d", tc.expectedV, byteFreed)
+			}
+		})
+	}
+}
+
+func TestSkipHole(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestSkipHole-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		fileSize  int64
+		holeSize  int64
+		zeroSize  int64
+		expectedV int64
+	}{
+		{"empty", 0, 0, 0, 0},
+		{"no hole", 4 * fsBlockSize, 0, 0, 0},
+		{"2fsb hole", 4 * fsBlockSize, 2 * fsBlockSize, 0, 2 * fsBlockSize},
+		{"only hole", 4 * fsBlockSize, 4 * fsBlockSize, 0, 4 * fsBlockSize},
+		{"zeroed partial block", 4 * fsBlockSize, 2 * fsBlockSize, 100, 2*fsBlockSize + 100},
+		{"zeroed block", 4 * fsBlockSize, 2 * fsBlockSize, fsBlockSize, 3 * fsBlockSize},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			err = file.Truncate(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.WriteAt(bytes.Repeat([]byte{'x'}, int(tc.fileSize)), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.holeSize > 0 {
+				err = unix.Fallocate(int(file.Fd()),
+					unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, tc.holeSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.zeroSize > 0 {
+				_, err = file.WriteAt(make([]byte, tc.zeroSize), tc.holeSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = file.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			offset, err := SkipHole(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if offset != tc.expectedV {
+				t.Errorf("expected: %d, got: %d", tc.expectedV, offset)
+			}
+			currentOffset, _ := file.Seek(0, 1)
+			if currentOffset != offset {
+				t.Errorf("read offset, expected: %d, got: %d", offset, currentOffset)
+			}
+		})
+	}
+}
+
+func TestCollapseFileStart(t *testing.T) {
+	var err error
+	var file *os.File
+	var fsBlockSize int64
+
+	// check the filesystem can collapse
+	capabilities, err := Probe(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCollapseErr error
+	if !capabilities.Collapse {
+		// CollapseFileStart return a *CollapseError wrapping it
+		testCollapseErr = unix.EOPNOTSUPP
+	}
+
+	// get fs block size
+	file, err = ioutil.TempFile(".", "dump-deallocate-TestCollapseFileStart-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsBlockSize, err = FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is collapsed if the filesystem can't
+	byteCollapsed := fsBlockSize
+	if testCollapseErr != nil {
+		byteCollapsed = 0
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create function used on each test
+	createTestFile := func(size int64) {
+
+		file, err = ioutil.TempFile(".", "dump-deallocate-TestCollapseFileStart-")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// mode 0 = Default: allocate disk space
+		err = unix.Fallocate(int(file.Fd()), 0, 0, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var byteActualyDeallocated int64
+
+	testCases := []struct {
+		name                string
+		fileSize           int64
+		bytesToDeallocate int64
+		expectedV          int64
+		expectedE          error
+	}{
+		{"1fsb|-1", fsBlockSize, -1, 0, errorZero},
+		{"1fsb|1", fsBlockSize, 1, 0, errorLessThanOneFsb},
+		{"2fsb|1fsb", 2 * fsBlockSize, fsBlockSize, byteCollapsed, testCollapseErr},
+		{"2fsb|1.5fsb", 2 * fsBlockSize, fsBlockSize + fsBlockSize/2, byteCollapsed, testCollapseErr},
+	}
+
+	// check CollapseFileStart
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			createTestFile(tc.fileSize)
+			defer os.Remove(file.Name())
+			defer file.Close()
+
+			byteActualyDeallocated, err = CollapseFileStart(file, tc.bytesToDeallocate)
+
+			if !errors.Is(err, tc.expectedE) {
+				t.Fatalf("expected error %v, got err: %v", tc.expectedE, err)
+			}
+
+			if byteActualyDeallocated != tc.expectedV {
+				t.Errorf("expected: %d, got: %d",
+					tc.expectedV,
+					byteActualyDeallocated)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"fmt"
+)
+
+/**
+ * Errors returned by Drain and CopyWhileDeallocate, one type per failure class.
+ * They carry where the failure happened and wrap the underlying error
+ * (usually a unix.Errno), so errors.As give the details and errors.Is the errno:
+ *   var punchErr *dumpdealloc.PunchError
+ *   if errors.As(err, &punchErr) && errors.Is(err, unix.EOPNOTSUPP) { … }
+ * The other failures (fstat, lseek, state file…) are *os.PathError.
+ */
+
+// Fail to read file
+type ReadError struct {
+	Offset int64 /* offset of file where the read failed */
+	Err    error
+}
+
+func (err *ReadError) Error() string {
+	return fmt.Sprintf("read at offset %d: %v", err.Offset, err.Err)
+}
+
+func (err *ReadError) Unwrap() error { return err.Err }
+
+// Fail to write (or make durable) the bytes read from file on output
+type WriteError struct {
+	Offset       int64 /* offset of file of the first byte of the chunk */
+	ByteToWrite  int64 /* bytes of the chunk (0 when making output durable) */
+	ByteWritten  int64 /* bytes of the chunk written before the failure */
+	TotalWritten int64 /* bytes written on output since the start of the dump */
+	Err          error
+}
+
+func (err *WriteError) Error() string {
+	if err.ByteToWrite == 0 {
+		return fmt.Sprintf("flush output after %d bytes: %v", err.TotalWritten, err.Err)
+	}
+	return fmt.Sprintf("write %d bytes from offset %d (%d written): %v",
+		err.ByteToWrite, err.Offset, err.ByteWritten, err.Err)
+}
+
+func (err *WriteError) Unwrap() error { return err.Err }
+
+// Fail to deallocate (fallocate punch-hole) bytes of file
+type PunchError struct {
+	Start int64 /* offset of file where the punch-hole start */
+	End   int64 /* offset of file where the punch-hole end */
+	Err   error
+}
+
+func (err *PunchError) Error() string {
+	return fmt.Sprintf("punch-hole from %d to %d: %v", err.Start, err.End, err.Err)
+}
+
+func (err *PunchError) Unwrap() error { return err.Err }
+
+// Fail to collapse (fallocate collapse-range) the start of file
+type CollapseError struct {
+	Length int64 /* bytes we tried to remove from the start of file */
+	Err    error
+}
+
+func (err *CollapseError) Error() string {
+	return fmt.Sprintf("collapse the first %d bytes: %v", err.Length, err.Err)
+}
+
+func (err *CollapseError) Unwrap() error { return err.Err }
+
+// The deallocation strategy can't be used (Options.Strategy), file is untouched
+type StrategyError struct {
+	Strategy Strategy
+	Err      error
+}
+
+func (err *StrategyError) Error() string {
+	return fmt.Sprintf("%v strategy: %v", err.Strategy, err.Err)
+}
+
+func (err *StrategyError) Unwrap() error { return err.Err }
@@ -0,0 +1,78 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadError(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestReadError-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write([]byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file is write only, the read fail
+	writeOnly, err := os.OpenFile(file.Name(), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writeOnly.Close()
+
+	var result Result
+	err = CopyWhileDeallocate(context.Background(), writeOnly, new(bytes.Buffer), Options{}, &result)
+
+	var readErr *ReadError
+	if !errors.As(err, &readErr) || !errors.Is(err, unix.EBADF) {
+		t.Fatalf("expected a ReadError of %v, got: %v", unix.EBADF, err)
+	}
+	if readErr.Offset != 0 || result.SafeResumeOffset != 0 {
+		t.Errorf("offset, expected: 0, got: %d (safe resume offset %d)", readErr.Offset, result.SafeResumeOffset)
+	}
+}
+
+func TestPunchError(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestPunchError-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(make([]byte, 2*fsBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file is read only, the punch-hole fail
+	readOnly, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+
+	_, err = PunchHole(readOnly, 0, fsBlockSize, fsBlockSize)
+
+	var punchErr *PunchError
+	if !errors.As(err, &punchErr) || !errors.Is(err, unix.EBADF) {
+		t.Fatalf("expected a PunchError of %v, got: %v", unix.EBADF, err)
+	}
+	if punchErr.Start != 0 || punchErr.End != fsBlockSize {
+		t.Errorf("range, expected: 0 %d, got: %d %d", fsBlockSize, punchErr.Start, punchErr.End)
+	}
+}
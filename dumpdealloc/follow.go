@@ -0,0 +1,149 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// how often we check the file size when inotify isn't available
+var followPollInterval = 1 * time.Second
+
+// how long we stay blocked on inotify before checking the context
+var followInotifyInterval = 200 * time.Millisecond
+
+/**
+ * Wait for bytes to be appended to a file (Options.Follow).
+ * Use inotify when available and fall back on polling the file size otherwise.
+ */
+type fileWatcher struct {
+	file      *os.File
+	inotifyFd int /* -1 if inotify isn't available */
+}
+
+/**
+ * Create a fileWatcher on file.
+ * If inotify can't be used, the watcher silently fall back on polling.
+ */
+func newFileWatcher(file *os.File) *fileWatcher {
+	watcher := &fileWatcher{file: file, inotifyFd: -1}
+
+	inotifyFd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return watcher
+	}
+
+	// we watch the inode, so a rename of file doesn't matter
+	_, err = unix.InotifyAddWatch(inotifyFd, file.Name(), unix.IN_MODIFY)
+	if err != nil {
+		unix.Close(inotifyFd)
+		return watcher
+	}
+
+	watcher.inotifyFd = inotifyFd
+	return watcher
+}
+
+// Release the inotify file descriptor (if any)
+func (watcher *fileWatcher) Close() {
+	if watcher.inotifyFd >= 0 {
+		unix.Close(watcher.inotifyFd)
+		watcher.inotifyFd = -1
+	}
+}
+
+/**
+ * Wait until the size of the watched file is greater than offset.
+ * Return true if new bytes are available, false if timeout expired without
+ * the file growing (0 means no timeout) or if ctx is done.
+ * If the file has been truncated below offset (logrotate copytruncate…), its
+ * bytes aren't the ones dumped anymore: ErrFileTruncated is returned.
+ *
+ * Can return: nil, *os.PathError, *os.SyscallError or ErrFileTruncated
+ */
+func (watcher *fileWatcher) WaitForData(ctx context.Context, offset int64, timeout time.Duration) (bool, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		var fileInfo unix.Stat_t
+		err := unix.Fstat(int(watcher.file.Fd()), &fileInfo)
+		if err != nil {
+			return false, &os.PathError{Op: "fstat", Path: watcher.file.Name(), Err: err}
+		}
+
+		if fileInfo.Size > offset {
+			return true, nil
+		}
+		if fileInfo.Size < offset {
+			return false, ErrFileTruncated
+		}
+
+		if ctx.Err() != nil {
+			return false, nil
+		}
+
+		wait := followPollInterval
+		if watcher.inotifyFd >= 0 {
+			wait = followInotifyInterval
+		}
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return false, nil
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+
+		if watcher.inotifyFd < 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		pollFds := []unix.PollFd{{Fd: int32(watcher.inotifyFd), Events: unix.POLLIN}}
+		_, err = unix.Poll(pollFds, int(wait/time.Millisecond))
+		if err != nil && err != unix.EINTR {
+			return false, os.NewSyscallError("poll", err)
+		}
+
+		// drain the inotify events, we only care about the file size
+		eventsBuffer := make([]byte, 4096)
+		for {
+			_, err = unix.Read(watcher.inotifyFd, eventsBuffer)
+			if err != nil {
+				break
+			}
+		}
+	}
+}
+
+var ErrFileTruncated = errors.New("the file has been truncated below the offset dumped")
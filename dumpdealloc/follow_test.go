@@ -0,0 +1,103 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWaitForData(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestWaitForData-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	watcher := newFileWatcher(file)
+	defer watcher.Close()
+
+	t.Run("timeout", func(t *testing.T) {
+		dataAvailable, err := watcher.WaitForData(context.Background(), 0, 100*time.Millisecond)
+		if err != nil || dataAvailable {
+			t.Errorf("got data (%v); expected timeout", err)
+		}
+	})
+
+	t.Run("append", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			file.Write([]byte("appended"))
+		}()
+		dataAvailable, err := watcher.WaitForData(context.Background(), 0, 5*time.Second)
+		if err != nil || !dataAvailable {
+			t.Errorf("got timeout (%v); expected data", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		dataAvailable, err := watcher.WaitForData(context.Background(), 1024, 5*time.Second)
+		if err != ErrFileTruncated || dataAvailable {
+			t.Errorf("got data (%v); expected %v", err, ErrFileTruncated)
+		}
+	})
+}
+
+func TestCopyWhileDeallocateFollow(t *testing.T) {
+	testContent, err := ioutil.ReadFile("../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(testContent) / 2
+
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateFollow-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	_, err = file.Write(testContent[:half])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a writer append the second half while we are following
+	writer, err := os.OpenFile(file.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		writer.Write(testContent[half:])
+	}()
+
+	options := Options{Follow: true, IdleTimeout: 1 * time.Second}
+
+	outputBuffer := new(bytes.Buffer)
+	var result Result
+	err = CopyWhileDeallocate(context.Background(), file, outputBuffer, options, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileTotalByteDeallocated := result.ByteDeallocated
+
+	if !bytes.Equal(testContent, outputBuffer.Bytes()) {
+		t.Errorf("content hasn't been copied correctly, see '%s'", file.Name())
+	}
+	if fileTotalByteDeallocated != int64(len(testContent)) {
+		t.Errorf("deallocated, expected: '%v', got '%v'", len(testContent), fileTotalByteDeallocated)
+	}
+}
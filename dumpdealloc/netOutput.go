@@ -0,0 +1,462 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maximum number of bytes sent but not acknowledged, Write blocks beyond
+var netWindow int64 = 64 * 1024 * 1024 /* 64MiB */
+
+// time allowed to the receiver to acknowledge before we consider the connection dead
+var netAckTimeout = 60 * time.Second
+
+var netDialTimeout = 10 * time.Second
+
+// delay between reconnection attempts (doubled after each failure) and
+// how long we try before giving up
+var netReconnectMinDelay = 100 * time.Millisecond
+var netReconnectMaxDelay = 10 * time.Second
+var netReconnectTimeout = 5 * time.Minute
+
+// how long the first connection wait for the receiver to end another
+// connection of the source (a previous run which just stopped)
+var netBusyTimeout = 10 * time.Second
+
+/**
+ * Network output (--output tcp://host:port or unix:///path).
+ * Send the dump to a receiver (dump-deallocate receive) which acknowledges
+ * the bytes once they are durable. Durable return the acknowledged bytes, so
+ * CopyWhileDeallocate only deallocates those.
+ * The bytes not acknowledged are kept in memory (up to netWindow) and sent
+ * again after a reconnection.
+ */
+type NetOutput struct {
+	Logger *log.Logger /* the reconnections, nil: no output */
+
+	network string
+	address string
+	source  string
+
+	mutex     sync.Mutex
+	ackedCond *sync.Cond /* signaled on ack and on connection error */
+	conn      net.Conn   /* nil when disconnected */
+	connErr   error      /* error of conn, set by the ack reader */
+	fatalErr  error      /* error sent by the receiver, we stop here */
+
+	base         int64 /* stream offset of the first byte written on the output */
+	written      int64
+	durable      int64
+	unacked      []netChunk
+	unackedBytes int64
+}
+
+// a chunk sent but not acknowledged yet
+type netChunk struct {
+	offset int64 /* stream offset */
+	data   []byte
+}
+
+/**
+ * Connect to the receiver at address for source.
+ * start is the stream offset of the first byte written, saved by a previous
+ * run (see State.Stream): the bytes the receiver already has after start are
+ * not written twice. With StreamOffsetUnknown, the dump is appended to what
+ * the receiver already has for source.
+ * If the receiver is receiving source from another connection, wait up to
+ * netBusyTimeout for it to end.
+ *
+ * Can return: nil, errorReceiver, errorSourceBusy, errorReceiverLostData,
+ * errorReceiverAhead or net errors
+ */
+func DialNetOutput(network string, address string, source string, start int64) (*NetOutput, error) {
+	output := &NetOutput{network: network, address: address, source: source, base: start}
+	output.ackedCond = sync.NewCond(&output.mutex)
+
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	delay := netReconnectMinDelay
+	deadline := time.Now().Add(netBusyTimeout)
+	for {
+		err := output.connect(true)
+		if err == nil {
+			return output, nil
+		}
+		if err != errorSourceBusy || time.Now().After(deadline) {
+			return nil, err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > netReconnectMaxDelay {
+			delay = netReconnectMaxDelay
+		}
+	}
+}
+
+/**
+ * Default source name of file: <hostname>-<file base name>-<id>, id is a hash
+ * of the absolute path, the device and the inode of file, so two files with
+ * the same base name (or the same path after a rotation) are different sources.
+ *
+ * Can return: nil, *os.PathError or os.Getwd errors
+ */
+func NetSourceName(file *os.File) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	absolutePath, err := filepath.Abs(file.Name())
+	if err != nil {
+		return "", err
+	}
+	var fileInfo unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfo)
+	if err != nil {
+		return "", &os.PathError{Op: "fstat", Path: file.Name(), Err: err}
+	}
+
+	id := fnv.New64a()
+	fmt.Fprintf(id, "%s\x00%d:%d", absolutePath, fileInfo.Dev, fileInfo.Ino)
+	return fmt.Sprintf("%s-%s-%016x", hostname, filepath.Base(file.Name()), id.Sum64()), nil
+}
+
+/**
+ * Open a connection, say hello and send again the bytes not acknowledged.
+ * On the first connection, if base is StreamOffsetUnknown, it is set to the
+ * offset the receiver is at.
+ * A busy receiver (another connection for source) isn't a fatal error, the
+ * other connection may be our previous one, not closed yet on the receiver.
+ * Must be called with mutex locked.
+ */
+func (output *NetOutput) connect(first bool) error {
+	conn, err := net.DialTimeout(output.network, output.address, netDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	start := output.base + output.durable
+	if first {
+		start = output.base
+	}
+
+	conn.SetDeadline(time.Now().Add(netAckTimeout))
+	err = writeHello(conn, output.source, start)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// the receiver tell us where it is
+	received, err := readFrame(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if received.kind == frameError {
+		conn.Close()
+		output.fatalErr = &errorReceiver{received.message}
+		return output.fatalErr
+	}
+	if received.kind == frameBusy {
+		conn.Close()
+		return errorSourceBusy
+	}
+	if received.kind != frameAck {
+		conn.Close()
+		return errorUnknownFrame
+	}
+
+	// the receiver start where we asked
+	if start == StreamOffsetUnknown {
+		output.base = received.offset
+	} else if received.offset < start {
+		conn.Close()
+		output.fatalErr = errorReceiverLostData
+		return output.fatalErr
+	} else if received.offset > start {
+		conn.Close()
+		output.fatalErr = errorReceiverAhead
+		return output.fatalErr
+	}
+
+	// send again what hasn't been acknowledged
+	for _, chunk := range output.unacked {
+		err = writeDataFrame(conn, chunk.offset, chunk.data)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	if output.unackedBytes > 0 {
+		conn.SetReadDeadline(time.Now().Add(netAckTimeout))
+	}
+	output.conn, output.connErr = conn, nil
+	go output.readAcks(conn)
+	return nil
+}
+
+/**
+ * Close the current connection and connect again, with a growing delay
+ * between attempts, until netReconnectTimeout.
+ * Must be called with mutex locked.
+ */
+func (output *NetOutput) reconnect() error {
+	if output.conn != nil {
+		output.conn.Close()
+		output.conn = nil
+	}
+
+	delay := netReconnectMinDelay
+	deadline := time.Now().Add(netReconnectTimeout)
+	for {
+		err := output.connect(false)
+		if err == nil {
+			return nil
+		}
+		if output.fatalErr != nil || time.Now().After(deadline) {
+			return err
+		}
+
+		logPrintf(output.Logger, "netOutput, connection to %s failed err='%v', retry in %v", output.address, err, delay)
+		output.mutex.Unlock()
+		time.Sleep(delay)
+		output.mutex.Lock()
+
+		delay *= 2
+		if delay > netReconnectMaxDelay {
+			delay = netReconnectMaxDelay
+		}
+	}
+}
+
+/**
+ * Forget the chunks acknowledged by an ack of offset, must be called with mutex locked.
+ * The receiver can't have more than what we sent: it is writing the bytes of
+ * another client (or another file) in the same stream, we stop there.
+ *
+ * Can return: nil or errorReceiverAhead
+ */
+func (output *NetOutput) acknowledge(offset int64) error {
+	if offset-output.base > output.written {
+		output.fatalErr = errorReceiverAhead
+		return output.fatalErr
+	}
+	if offset-output.base <= output.durable {
+		return nil
+	}
+	output.durable = offset - output.base
+
+	for len(output.unacked) > 0 {
+		chunk := output.unacked[0]
+		if chunk.offset+int64(len(chunk.data)) > offset {
+			break
+		}
+		output.unacked = output.unacked[1:]
+		output.unackedBytes -= int64(len(chunk.data))
+	}
+	return nil
+}
+
+// Read the frames sent by the receiver on conn until an error
+func (output *NetOutput) readAcks(conn net.Conn) {
+	for {
+		received, err := readFrame(conn)
+
+		output.mutex.Lock()
+		if output.conn != conn {
+			// we already moved to another connection
+			output.mutex.Unlock()
+			return
+		}
+
+		if err == nil && received.kind == frameAck {
+			err = output.acknowledge(received.offset)
+			if err == nil {
+				if output.unackedBytes > 0 {
+					conn.SetReadDeadline(time.Now().Add(netAckTimeout))
+				} else {
+					conn.SetReadDeadline(time.Time{})
+				}
+				output.ackedCond.Broadcast()
+				output.mutex.Unlock()
+				continue
+			}
+		}
+
+		if err == nil && received.kind == frameError {
+			output.fatalErr = &errorReceiver{received.message}
+			err = output.fatalErr
+		} else if err == nil {
+			err = errorUnknownFrame
+		}
+		output.connErr = err
+		output.ackedCond.Broadcast()
+		output.mutex.Unlock()
+		return
+	}
+}
+
+/**
+ * Send chunk, reconnecting if needed (which send it again with the other
+ * unacknowledged chunks). Must be called with mutex locked.
+ */
+func (output *NetOutput) send(chunk netChunk) error {
+	if output.conn == nil || output.connErr != nil {
+		return output.reconnect()
+	}
+
+	output.conn.SetWriteDeadline(time.Now().Add(netAckTimeout))
+	err := writeDataFrame(output.conn, chunk.offset, chunk.data)
+	if err != nil {
+		logPrintf(output.Logger, "netOutput, send to %s failed err='%v'", output.address, err)
+		output.connErr = err
+		return output.reconnect()
+	}
+	output.conn.SetReadDeadline(time.Now().Add(netAckTimeout))
+	return nil
+}
+
+/**
+ * Wait for an ack (or a connection error, then reconnect).
+ * Must be called with mutex locked.
+ */
+func (output *NetOutput) waitAck() error {
+	if output.fatalErr != nil {
+		return output.fatalErr
+	}
+	if output.conn == nil || output.connErr != nil {
+		if output.connErr != nil {
+			logPrintf(output.Logger, "netOutput, connection to %s lost err='%v'", output.address, output.connErr)
+		}
+		return output.reconnect()
+	}
+	output.ackedCond.Wait()
+	return nil
+}
+
+func (output *NetOutput) Write(buffer []byte) (nbByteWritten int, err error) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	for len(buffer) > 0 {
+		if output.fatalErr != nil {
+			return nbByteWritten, output.fatalErr
+		}
+
+		chunkLength := len(buffer)
+		if chunkLength > maxFrameDataLength {
+			chunkLength = maxFrameDataLength
+		}
+
+		// don't keep more than netWindow bytes in memory
+		for output.unackedBytes > 0 && output.unackedBytes+int64(chunkLength) > netWindow {
+			err = output.waitAck()
+			if err != nil {
+				return nbByteWritten, err
+			}
+		}
+
+		chunk := netChunk{offset: output.base + output.written, data: make([]byte, chunkLength)}
+		copy(chunk.data, buffer[:chunkLength])
+		output.unacked = append(output.unacked, chunk)
+		output.unackedBytes += int64(chunkLength)
+		output.written += int64(chunkLength)
+
+		err = output.send(chunk)
+		if err != nil {
+			return nbByteWritten, err
+		}
+
+		nbByteWritten += chunkLength
+		buffer = buffer[chunkLength:]
+	}
+	return nbByteWritten, nil
+}
+
+// Stream offset of the first byte written
+func (output *NetOutput) Base() int64 {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return output.base
+}
+
+func (output *NetOutput) Durable() int64 {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return output.durable
+}
+
+// Wait until all the written bytes are acknowledged
+func (output *NetOutput) Flush() error {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	for output.durable < output.written {
+		err := output.waitAck()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close the connection, the bytes not acknowledged (see Flush) are lost
+func (output *NetOutput) Close() error {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	output.fatalErr = errorClosed
+	if output.conn == nil {
+		return nil
+	}
+	err := output.conn.Close()
+	output.conn = nil
+	return err
+}
+
+// error sent by the receiver
+type errorReceiver struct {
+	message string
+}
+
+func (err *errorReceiver) Error() string {
+	return "receiver error: " + err.message
+}
+
+var errorReceiverLostData = errors.New("receiver lost acknowledged bytes")
+var errorReceiverAhead = errors.New("receiver acknowledged bytes which haven't been sent")
+var errorSourceBusy = errors.New("receiver is already receiving this source from another connection")
+var errorClosed = errors.New("network output closed")
@@ -0,0 +1,171 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * Minimal receiver: store the data frames in received and acknowledge them.
+ * The first connection is dropped after the first data frame, without ack.
+ */
+func fakeReceiver(t *testing.T, listener net.Listener, received *bytes.Buffer, done chan struct{}) {
+	defer close(done)
+
+	for connection := 0; ; connection++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, _, err = readHello(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		writeAckFrame(conn, int64(received.Len()))
+
+		for {
+			dataFrame, err := readFrame(conn)
+			if err != nil {
+				break
+			}
+			if connection == 0 {
+				// connection lost before the ack
+				break
+			}
+
+			// ignore what we already have
+			if dataFrame.offset+int64(len(dataFrame.data)) > int64(received.Len()) {
+				received.Write(dataFrame.data[int64(received.Len())-dataFrame.offset:])
+			}
+			writeAckFrame(conn, int64(received.Len()))
+		}
+		conn.Close()
+	}
+}
+
+func TestNetOutput(t *testing.T) {
+	netReconnectMinDelay = time.Millisecond
+	defer func() { netReconnectMinDelay = 100 * time.Millisecond }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := new(bytes.Buffer)
+	done := make(chan struct{})
+	go fakeReceiver(t, listener, received, done)
+
+	output, err := DialNetOutput("tcp", listener.Addr().String(), "test", StreamOffsetUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testContent := bytes.Repeat([]byte("dump-deallocate"), 10000)
+	for chunkStart := 0; chunkStart < len(testContent); chunkStart += 4096 {
+		chunkEnd := chunkStart + 4096
+		if chunkEnd > len(testContent) {
+			chunkEnd = len(testContent)
+		}
+		_, err = output.Write(testContent[chunkStart:chunkEnd])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Durable() != int64(len(testContent)) {
+		t.Errorf("durable, expected: %d, got: %d", len(testContent), output.Durable())
+	}
+
+	output.Close()
+	listener.Close()
+	<-done
+
+	if !bytes.Equal(testContent, received.Bytes()) {
+		t.Error("received content differ from the sent one")
+	}
+}
+
+func TestNetOutputReceiverAhead(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readHello(conn)
+		writeAckFrame(conn, 0)
+		dataFrame, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		// another client is writing in the same stream
+		writeAckFrame(conn, dataFrame.offset+int64(len(dataFrame.data))+4096)
+		readFrame(conn)
+	}()
+
+	output, err := DialNetOutput("tcp", listener.Addr().String(), "test", StreamOffsetUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	_, err = output.Write([]byte("dump-deallocate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.Flush()
+	if err != errorReceiverAhead {
+		t.Errorf("expected: %v, got: %v", errorReceiverAhead, err)
+	}
+	if output.Durable() != 0 {
+		t.Errorf("durable, expected: 0, got: %d", output.Durable())
+	}
+}
+
+func TestNetSourceName(t *testing.T) {
+	os.Mkdir("dump-deallocate-TestNetSourceName", 0755)
+	defer os.RemoveAll("dump-deallocate-TestNetSourceName")
+
+	first, err := os.Create("dump-deallocate-TestNetSourceName.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(first.Name())
+	defer first.Close()
+	second, err := os.Create("dump-deallocate-TestNetSourceName/dump-deallocate-TestNetSourceName.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	firstName, err := NetSourceName(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondName, err := NetSourceName(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstName == secondName {
+		t.Errorf("same source name for two files: %s", firstName)
+	}
+	if !strings.Contains(firstName, "-dump-deallocate-TestNetSourceName.log-") {
+		t.Errorf("base name not in the source name: %s", firstName)
+	}
+}
@@ -0,0 +1,117 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Process which has a file open
+type Opener struct {
+	PID     int
+	Command string /* /proc/PID/comm */
+}
+
+/**
+ * Return the processes, other than us, which have file open (they appear in
+ * /proc/PID/fd), and if file is open elsewhere according to a write lease
+ * attempt (F_SETLEASE), which also sees the processes /proc doesn't show us
+ * (other users' ones when we aren't root) but also our own other descriptors.
+ *
+ * Can return: nil or *os.PathError
+ */
+func FindOpeners(file *os.File) (openers []Opener, leaseBusy bool, err error) {
+	var fileStat unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileStat)
+	if err != nil {
+		return nil, false, &os.PathError{Op: "fstat", Path: file.Name(), Err: err}
+	}
+
+	// without /proc, only the lease tell
+	procEntries, _ := ioutil.ReadDir("/proc")
+	self := os.Getpid()
+	for _, procEntry := range procEntries {
+		pid, err := strconv.Atoi(procEntry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		if processHasOpen(pid, fileStat.Dev, fileStat.Ino) {
+			command, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+			openers = append(openers, Opener{PID: pid, Command: strings.TrimSpace(string(command))})
+		}
+	}
+
+	// a lease we already hold (see safeTruncater) is broken when another
+	// process open file
+	lease, err := unix.FcntlInt(file.Fd(), unix.F_GETLEASE, 0)
+	if err == nil && lease == unix.F_WRLCK {
+		return openers, false, nil
+	}
+	// EACCES (not our file) or EINVAL (not supported) tell nothing
+	_, err = unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_WRLCK)
+	if err == nil {
+		unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_UNLCK)
+	}
+	return openers, err == unix.EAGAIN, nil
+}
+
+// Return true if one of the descriptors of process pid is the inode dev:ino
+func processHasOpen(pid int, dev uint64, ino uint64) bool {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fdDirFile, err := os.Open(fdDir)
+	if err != nil {
+		// process gone, or not ours
+		return false
+	}
+	defer fdDirFile.Close()
+	fdNames, _ := fdDirFile.Readdirnames(-1)
+
+	for _, fdName := range fdNames {
+		var fdStat unix.Stat_t
+		err = unix.Stat(fdDir+"/"+fdName, &fdStat)
+		if err == nil && fdStat.Dev == dev && fdStat.Ino == ino {
+			return true
+		}
+	}
+	return false
+}
+
+// The end action has been refused because other processes have file open (see Options.Force)
+type OpenersError struct {
+	Action  EndAction
+	Openers []Opener /* empty if only the lease saw them */
+}
+
+func (err *OpenersError) Error() string {
+	if len(err.Openers) == 0 {
+		return fmt.Sprintf("file open by another process (unidentified), %v refused", err.Action)
+	}
+	openers := make([]string, len(err.Openers))
+	for index, opener := range err.Openers {
+		openers[index] = fmt.Sprintf("%d (%s)", opener.PID, opener.Command)
+	}
+	return fmt.Sprintf("file open by other processes: %s, %v refused", strings.Join(openers, ", "), err.Action)
+}
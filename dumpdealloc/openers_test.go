@@ -0,0 +1,89 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestFindOpeners(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestFindOpeners-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// nobody else
+	openers, leaseBusy, err := FindOpeners(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(openers) != 0 || leaseBusy {
+		t.Errorf("expected no opener, got: %v lease busy: %v", openers, leaseBusy)
+	}
+
+	// another descriptor of ours, only the lease see it
+	other, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	openers, leaseBusy, err = FindOpeners(file)
+	other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(openers) != 0 || !leaseBusy {
+		t.Errorf("expected the lease to be busy, got: %v lease busy: %v", openers, leaseBusy)
+	}
+
+	// another process, with file as stdin
+	sleep := exec.Command("sleep", "10")
+	sleep.Stdin = file
+	err = sleep.Start()
+	if err != nil {
+		t.Skip("can't start sleep: ", err)
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+
+	openers, _, err = FindOpeners(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(openers) != 1 || openers[0].PID != sleep.Process.Pid || openers[0].Command != "sleep" {
+		t.Errorf("expected opener: %d (sleep), got: %v", sleep.Process.Pid, openers)
+	}
+
+	// the end action is refused, unless Force
+	testCases := []struct {
+		force     bool
+		expectedE bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	for _, tc := range testCases {
+		_, err = file.WriteAt([]byte("some content\n"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Drain(context.Background(), file, new(bytes.Buffer), Options{EndAction: EndRemove, Force: tc.force})
+		var openersErr *OpenersError
+		if errors.As(err, &openersErr) != tc.expectedE {
+			t.Errorf("force: %v, expected OpenersError: %v, got: %v", tc.force, tc.expectedE, err)
+		}
+		_, statErr := os.Stat(file.Name())
+		if os.IsNotExist(statErr) == tc.expectedE {
+			t.Errorf("force: %v, expected file removed: %v", tc.force, !tc.expectedE)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+/**
+ * An output which doesn't make the written bytes durable as soon as Write returns.
+ * CopyWhileDeallocate only deallocates from FILE the bytes reported by Durable.
+ */
+type DurableWriter interface {
+	io.Writer
+	// number of bytes, among the ones written on the writer, which are durable
+	Durable() int64
+	// make all the written bytes durable
+	Flush() error
+}
+
+/**
+ * Output file (--output).
+ * Written bytes are made durable with fdatasync once syncEvery bytes have
+ * been written since the last fdatasync (0 means after each Write).
+ */
+type FileOutput struct {
+	file      *os.File
+	syncEvery int64
+	written   int64
+	durable   int64
+}
+
+/**
+ * Create the output file path (it must not exist) or, with appendMode,
+ * open it in append mode (creating it if needed).
+ *
+ * Can return: nil or os errors
+ */
+func OpenFileOutput(path string, appendMode bool, syncEvery int64) (*FileOutput, error) {
+	openFlags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if appendMode {
+		openFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(path, openFlags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileOutput{file: file, syncEvery: syncEvery}, nil
+}
+
+func (output *FileOutput) Write(buffer []byte) (nbByteWritten int, err error) {
+	nbByteWritten, err = output.file.Write(buffer)
+	if err != nil {
+		output.written += int64(nbByteWritten)
+		return nbByteWritten, err
+	}
+	return nbByteWritten, output.wrote(nbByteWritten)
+}
+
+// Account nbByteWritten bytes written on the file (by Write or a zeroCopier)
+func (output *FileOutput) wrote(nbByteWritten int) error {
+	output.written += int64(nbByteWritten)
+	if output.written-output.durable >= output.syncEvery {
+		return output.Flush()
+	}
+	return nil
+}
+
+func (output *FileOutput) Durable() int64 {
+	return output.durable
+}
+
+func (output *FileOutput) Flush() error {
+	if output.durable == output.written {
+		return nil
+	}
+
+	err := unix.Fdatasync(int(output.file.Fd()))
+	if err != nil {
+		return err
+	}
+	output.durable = output.written
+	return nil
+}
+
+// Flush and close the output file
+func (output *FileOutput) Close() error {
+	err := output.Flush()
+	closeErr := output.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Count the bytes written on writer
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (counter *countingWriter) Write(buffer []byte) (int, error) {
+	nbByteWritten, err := counter.writer.Write(buffer)
+	counter.written += int64(nbByteWritten)
+	return nbByteWritten, err
+}
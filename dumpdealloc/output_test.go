@@ -0,0 +1,151 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileOutput(t *testing.T) {
+	outputPath := "dump-deallocate-TestFileOutput"
+	defer os.Remove(outputPath)
+
+	output, err := OpenFileOutput(outputPath, false, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not durable until 1000 bytes are written
+	_, err = output.Write(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Durable() != 0 {
+		t.Errorf("durable, expected: 0, got: %d", output.Durable())
+	}
+
+	_, err = output.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Durable() != 1100 {
+		t.Errorf("durable, expected: 1100, got: %d", output.Durable())
+	}
+
+	_, err = output.Write(make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Durable() != 1110 {
+		t.Errorf("durable after Close, expected: 1110, got: %d", output.Durable())
+	}
+
+	// without append, the output must not exist
+	_, err = OpenFileOutput(outputPath, false, 0)
+	if !os.IsExist(err) {
+		t.Errorf("expected exist error, got: %v", err)
+	}
+
+	// with append we write after the existing bytes
+	output, err = OpenFileOutput(outputPath, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = output.Write([]byte("appended"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Durable() != int64(len("appended")) {
+		t.Errorf("durable, expected: %d, got: %d", len("appended"), output.Durable())
+	}
+	output.Close()
+
+	content, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(make([]byte, 1110), "appended"...)) {
+		t.Error("output file content isn't the expected one")
+	}
+}
+
+// DurableWriter which makes nothing durable until Flush, and check on each
+// Write that the source file hasn't been deallocated yet
+type lazyDurableWriter struct {
+	t       *testing.T
+	source  *os.File
+	output  bytes.Buffer
+	durable int64
+}
+
+func (writer *lazyDurableWriter) Write(buffer []byte) (int, error) {
+	firstByte := make([]byte, 1)
+	_, err := writer.source.ReadAt(firstByte, 0)
+	if err != nil {
+		writer.t.Fatal(err)
+	}
+	if firstByte[0] == 0 {
+		writer.t.Error("source deallocated before the output is durable")
+	}
+	return writer.output.Write(buffer)
+}
+
+func (writer *lazyDurableWriter) Durable() int64 {
+	return writer.durable
+}
+
+func (writer *lazyDurableWriter) Flush() error {
+	writer.durable = int64(writer.output.Len())
+	return nil
+}
+
+func TestCopyWhileDeallocateDurableOutput(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestCopyWhileDeallocateDurableOutput-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContent := bytes.Repeat([]byte{'x'}, int(8*fsBlockSize))
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := &lazyDurableWriter{t: t, source: file}
+	var result Result
+	err = CopyWhileDeallocate(context.Background(), file, output, Options{BufferSize: fsBlockSize}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileTotalByteDeallocated, fileTotalByteFreed := result.ByteDeallocated, result.ByteFreed
+
+	if !bytes.Equal(testContent, output.output.Bytes()) {
+		t.Errorf("content hasn't been copied correctly, see '%s'", file.Name())
+	}
+	if fileTotalByteDeallocated != int64(len(testContent)) {
+		t.Errorf("deallocated, expected: '%v', got '%v'", len(testContent), fileTotalByteDeallocated)
+	}
+	if fileTotalByteFreed != int64(len(testContent)) {
+		t.Errorf("freed, expected: '%v', got '%v'", len(testContent), fileTotalByteFreed)
+	}
+}
@@ -0,0 +1,234 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// a chunk of file read by readAhead
+type readChunk struct {
+	data []byte
+	err  error /* error of the read, io.EOF at the end of file */
+}
+
+/**
+ * Read file in a goroutine, ahead of the writes: while a chunk is written,
+ * up to inFlight-1 following chunks are read (one buffer per chunk).
+ * The chunks are read from the read offset of file, up to limit (<0: no limit).
+ * After an error (io.EOF included) the reader waits for the next call to next
+ * to read again, so the caller can wait for file to grow (Follow).
+ */
+type readAhead struct {
+	file     *os.File
+	free     chan []byte    /* buffers not in use */
+	chunks   chan readChunk /* chunks read, in the order of file */
+	retry    chan struct{}  /* read again after an error */
+	stopped  chan struct{}  /* closed by stop */
+	done     chan struct{}  /* closed when the goroutine returns */
+	stopOnce sync.Once
+	current  []byte /* buffer of the chunk returned by next */
+	failed   bool   /* the chunk returned by next had an error */
+}
+
+/**
+ * Start reading file at offset, with inFlight buffers of bufferSize bytes.
+ */
+func newReadAhead(file *os.File, offset int64, limit int64, inFlight int, bufferSize int64) *readAhead {
+	ahead := &readAhead{
+		file:    file,
+		free:    make(chan []byte, inFlight),
+		chunks:  make(chan readChunk, inFlight),
+		retry:   make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < inFlight; i++ {
+		ahead.free <- make([]byte, bufferSize)
+	}
+	go ahead.run(offset, limit)
+	return ahead
+}
+
+func (ahead *readAhead) run(offset int64, limit int64) {
+	defer close(ahead.done)
+	for {
+		var buffer []byte
+		select {
+		case buffer = <-ahead.free:
+		case <-ahead.stopped:
+			return
+		}
+		buffer = buffer[:cap(buffer)]
+
+		var n int
+		var err error
+		if limit >= 0 && limit-offset < int64(len(buffer)) {
+			buffer = buffer[:limit-offset]
+		}
+		if len(buffer) == 0 {
+			err = io.EOF
+		} else {
+			n, err = ahead.file.Read(buffer)
+		}
+		offset += int64(n)
+
+		select {
+		case ahead.chunks <- readChunk{data: buffer[:n], err: err}:
+		case <-ahead.stopped:
+			return
+		}
+
+		if err != nil {
+			select {
+			case <-ahead.retry:
+			case <-ahead.stopped:
+				return
+			}
+		}
+	}
+}
+
+/**
+ * Return the next chunk of file, its buffer is valid until the next call.
+ * After an error, read again from where the reader stopped.
+ */
+func (ahead *readAhead) next() ([]byte, error) {
+	if ahead.current != nil {
+		// free has room for all the buffers, it doesn't block
+		ahead.free <- ahead.current
+		ahead.current = nil
+	}
+	if ahead.failed {
+		ahead.retry <- struct{}{}
+		ahead.failed = false
+	}
+
+	chunk := <-ahead.chunks
+	ahead.current = chunk.data
+	ahead.failed = chunk.err != nil
+	return chunk.data, chunk.err
+}
+
+/**
+ * Stop the reader and wait for it. The read offset of file is then after the
+ * chunks read ahead, the caller has to move it back.
+ */
+func (ahead *readAhead) stop() {
+	ahead.stopOnce.Do(func() {
+		close(ahead.stopped)
+	})
+	<-ahead.done
+}
+
+/**
+ * Do the punch-holes in a goroutine, in the order they are queued, so the
+ * writes don't wait for them. Up to inFlight punch-holes are queued, after
+ * that queue waits.
+ * Once a punch-hole failed, the following ones are dropped and its error is
+ * returned by queue and wait.
+ */
+type punchQueue struct {
+	ends      chan int64    /* end offset of each punch-hole */
+	done      chan struct{} /* closed when the goroutine returns */
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	err       error
+}
+
+/**
+ * Start the goroutine calling punch for each end queued.
+ */
+func newPunchQueue(inFlight int, punch func(end int64) error) *punchQueue {
+	queue := &punchQueue{
+		ends: make(chan int64, inFlight),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(queue.done)
+		var err error
+		for end := range queue.ends {
+			if err != nil {
+				continue
+			}
+			err = punch(end)
+			if err != nil {
+				queue.mutex.Lock()
+				queue.err = err
+				queue.mutex.Unlock()
+			}
+		}
+	}()
+	return queue
+}
+
+/**
+ * Queue the punch-hole up to end.
+ *
+ * Can return: nil or the error of a previous punch-hole
+ */
+func (queue *punchQueue) queue(end int64) error {
+	queue.mutex.Lock()
+	err := queue.err
+	queue.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	queue.ends <- end
+	return nil
+}
+
+/**
+ * Wait for the queued punch-holes, no punch-hole can be queued afterward.
+ *
+ * Can return: nil or the error of a punch-hole
+ */
+func (queue *punchQueue) wait() error {
+	queue.closeOnce.Do(func() {
+		close(queue.ends)
+	})
+	<-queue.done
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.err
+}
+
+// Counters of the punch-holes, updated by the goroutine of punchQueue and read by the progress
+type punchCounters struct {
+	mutex         sync.Mutex
+	byteFreed     int64
+	byteReclaimed int64
+	blocksLast    int64
+}
+
+func (counters *punchCounters) set(byteFreed int64, byteReclaimed int64, blocksLast int64) {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.byteFreed, counters.byteReclaimed, counters.blocksLast = byteFreed, byteReclaimed, blocksLast
+}
+
+func (counters *punchCounters) get() (byteFreed int64, byteReclaimed int64, blocksLast int64) {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	return counters.byteFreed, counters.byteReclaimed, counters.blocksLast
+}
@@ -0,0 +1,234 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"unsafe"
+)
+
+// What a filesystem supports (see Probe)
+type Capabilities struct {
+	Filesystem string /* type of the filesystem (ext4, xfs…) */
+	BlockSize  int64
+	PunchHole  bool /* fallocate FALLOC_FL_PUNCH_HOLE */
+	ZeroRange  bool /* fallocate FALLOC_FL_ZERO_RANGE */
+	Collapse   bool /* fallocate FALLOC_FL_COLLAPSE_RANGE */
+	SeekHole   bool /* lseek SEEK_DATA/SEEK_HOLE (leading hole skipped on resume) */
+	Fiemap     bool /* ioctl FS_IOC_FIEMAP */
+	Direct     bool /* open O_DIRECT */
+	Lease      bool /* fcntl F_SETLEASE (other processes opening file detected) */
+}
+
+// names of the filesystem types (statfs f_type)
+var filesystemNames = map[int64]string{
+	unix.EXT4_SUPER_MAGIC:      "ext2/ext3/ext4",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	0x2fc12fc1:                 "zfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlayfs",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.CIFS_SUPER_MAGIC:      "cifs",
+	unix.SMB2_SUPER_MAGIC:      "smb2",
+	unix.CEPH_SUPER_MAGIC:      "ceph",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.EXFAT_SUPER_MAGIC:     "exfat",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+}
+
+/**
+ * Probe what the filesystem of dir supports, on a temporary file created
+ * (and removed) in dir: the fallocate modes, SEEK_DATA/SEEK_HOLE, FIEMAP,
+ * O_DIRECT and leases.
+ *
+ * Can return: nil or os errors
+ */
+func Probe(dir string) (capabilities Capabilities, err error) {
+	var filesystemInfo unix.Statfs_t
+	err = unix.Statfs(dir, &filesystemInfo)
+	if err != nil {
+		return capabilities, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	capabilities.Filesystem = filesystemName(int64(filesystemInfo.Type))
+	capabilities.BlockSize = int64(filesystemInfo.Bsize)
+
+	file, err := ioutil.TempFile(dir, "dump-deallocate-probe-")
+	if err != nil {
+		return capabilities, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// nobody else has the probe file open
+	_, err = unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_WRLCK)
+	if err == nil {
+		capabilities.Lease = true
+		unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_UNLCK)
+	}
+
+	direct, err := os.OpenFile(file.Name(), os.O_RDONLY|unix.O_DIRECT, 0)
+	if err == nil {
+		capabilities.Direct = true
+		direct.Close()
+	}
+
+	// 3 filesystem blocks of data, written (fallocate may not be supported at all)
+	fsBlockSize := capabilities.BlockSize
+	_, err = file.Write(make([]byte, 3*fsBlockSize))
+	if err != nil {
+		return capabilities, err
+	}
+
+	capabilities.PunchHole, err = probeFallocate(file,
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, fsBlockSize)
+	if err != nil {
+		return capabilities, err
+	}
+	capabilities.ZeroRange, err = probeFallocate(file,
+		unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE, fsBlockSize, fsBlockSize)
+	if err != nil {
+		return capabilities, err
+	}
+	capabilities.Collapse, err = probeFallocate(file,
+		unix.FALLOC_FL_COLLAPSE_RANGE, 0, fsBlockSize)
+	if err != nil {
+		return capabilities, err
+	}
+
+	// EINVAL if the filesystem doesn't know SEEK_DATA/SEEK_HOLE
+	_, err = unix.Seek(int(file.Fd()), 0, unix.SEEK_DATA)
+	if err != unix.EINVAL {
+		_, err = unix.Seek(int(file.Fd()), 0, unix.SEEK_HOLE)
+		capabilities.SeekHole = err != unix.EINVAL
+	}
+
+	capabilities.Fiemap = probeFiemap(file)
+	return capabilities, nil
+}
+
+// Return the name of the filesystem type fsType (statfs f_type)
+func filesystemName(fsType int64) string {
+	name, known := filesystemNames[fsType]
+	if !known {
+		return fmt.Sprintf("0x%x", fsType)
+	}
+	return name
+}
+
+/**
+ * Try fallocate mode on file, return false if the filesystem doesn't support it.
+ *
+ * Can return: nil or *os.PathError
+ */
+func probeFallocate(file *os.File, mode uint32, offset int64, length int64) (supported bool, err error) {
+	err = unix.Fallocate(int(file.Fd()), mode, offset, length)
+	switch err {
+	case nil:
+		return true, nil
+	case unix.EOPNOTSUPP, unix.ENOSYS:
+		return false, nil
+	}
+	return false, &os.PathError{Op: "fallocate", Path: file.Name(), Err: err}
+}
+
+// how far after the end of file probeFilePunchHole punch, out of reach of a concurrent append
+const probePastEOF = 1024 * 1024 * 1024 /* 1GiB */
+
+/**
+ * Tell if file supports fallocate punch-hole, without allocating nor changing
+ * anything: a filesystem block after the end of file is punched with
+ * KEEP_SIZE (there is nothing there).
+ *
+ * Can return: nil or *os.PathError
+ */
+func probeFilePunchHole(file *os.File) (supported bool, err error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		return false, err
+	}
+
+	offset := fileInfo.Size()/fsBlockSize*fsBlockSize + probePastEOF
+	return probeFallocate(file, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, fsBlockSize)
+}
+
+// ioctl FS_IOC_FIEMAP (linux/fiemap.h), not in x/sys/unix
+const fsIocFiemap = 0xc020660b
+
+// struct fiemap without extents: only the number of extents is asked
+type fiemapHeader struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+}
+
+// Return true if the extents of file can be listed with FIEMAP
+func probeFiemap(file *os.File) bool {
+	header := fiemapHeader{length: ^uint64(0)}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&header)))
+	return errno == 0
+}
+
+// Return the strategy StrategyAuto use on the filesystem (see chooseStrategy)
+func (capabilities Capabilities) Strategy() Strategy {
+	if capabilities.PunchHole {
+		return StrategyPunchHole
+	}
+	return StrategyCopyRename
+}
+
+/**
+ * Tell if strategy is safe on the filesystem, otherwise why.
+ * copy-rename needs leases: without them a process opening file during the
+ * rewrite isn't detected, its writes would be lost.
+ */
+func (capabilities Capabilities) Safe(strategy Strategy) (safe bool, reason string) {
+	switch strategy {
+	case StrategyAuto:
+		return capabilities.Safe(capabilities.Strategy())
+	case StrategyPunchHole:
+		if !capabilities.PunchHole {
+			return false, "fallocate punch-hole not supported"
+		}
+	case StrategyZeroRange:
+		if !capabilities.ZeroRange {
+			return false, "fallocate zero-range not supported"
+		}
+	case StrategyCopyRename:
+		if !capabilities.Lease {
+			return false, "leases not supported, the processes opening FILE during the rewrite aren't detected"
+		}
+	}
+	return true, ""
+}
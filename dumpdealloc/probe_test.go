@@ -0,0 +1,81 @@
+package dumpdealloc
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	capabilities, err := Probe(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := StrategyCopyRename
+	if capabilities.PunchHole {
+		expected = StrategyPunchHole
+	}
+	if capabilities.Strategy() != expected {
+		t.Errorf("strategy of %+v, expected: %v, got: %v", capabilities, expected, capabilities.Strategy())
+	}
+	if len(capabilities.Filesystem) == 0 || capabilities.BlockSize <= 0 {
+		t.Errorf("filesystem and block size, got: %q %d", capabilities.Filesystem, capabilities.BlockSize)
+	}
+	if safe, _ := capabilities.Safe(StrategyAuto); safe != (expected != StrategyCopyRename || capabilities.Lease) {
+		t.Errorf("safety of the auto strategy of %+v, got: %v", capabilities, safe)
+	}
+
+	// the probe file is removed
+	probeFiles, err := filepath.Glob("dump-deallocate-probe-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probeFiles) != 0 {
+		t.Errorf("probe files left: %v", probeFiles)
+	}
+}
+
+func TestProbeFilePunchHole(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestProbeFilePunchHole-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write([]byte("dump-deallocate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileInfoBefore unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfoBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	supported, err := probeFilePunchHole(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capabilities, err := Probe(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if supported != capabilities.PunchHole {
+		t.Errorf("punch-hole supported, expected: %v, got: %v", capabilities.PunchHole, supported)
+	}
+
+	// nothing changed
+	var fileInfoAfter unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfoAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfoAfter.Size != fileInfoBefore.Size || fileInfoAfter.Blocks != fileInfoBefore.Blocks {
+		t.Errorf("size and blocks, expected: %d %d, got: %d %d",
+			fileInfoBefore.Size, fileInfoBefore.Blocks, fileInfoAfter.Size, fileInfoAfter.Blocks)
+	}
+}
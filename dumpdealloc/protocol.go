@@ -0,0 +1,261 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+/**
+ * Protocol between a network output (--output tcp://… or unix://…) and
+ * a receiver (dump-deallocate receive).
+ *
+ * The client open the connection with a hello:
+ *   "DDH1" | source name length (uint16) | source name | start offset (uint64)
+ * then send data frames and the receiver answer with ack frames:
+ *   'D' | offset (uint64) | length (uint32) | data
+ *   'A' | offset (uint64)
+ *   'E' | message length (uint16) | message
+ *   'B'
+ *
+ * Offsets are offsets in the stream of the source (the file written by the
+ * receiver). The start offset is the offset of the first byte the client is
+ * about to send, as saved by a previous run (--state) or after a reconnection,
+ * or StreamOffsetUnknown (all bits set).
+ * The first frame sent by the receiver is an ack of the start offset (of the
+ * bytes it already has for this source when the start offset is unknown), the
+ * client start (or resume) from there. The data frames before the end of what
+ * the receiver has are acknowledged but not written again.
+ * An ack of offset N means all the bytes before N are durable on the receiver.
+ * The receiver answer a busy frame ('B') when another connection is already
+ * receiving the source.
+ * Integers are big endian.
+ */
+
+const protocolMagic = "DDH1"
+
+// start offset of a client which doesn't know where it is in the stream
+const StreamOffsetUnknown int64 = -1
+
+const (
+	frameData  byte = 'D'
+	frameAck   byte = 'A'
+	frameError byte = 'E'
+	frameBusy  byte = 'B'
+)
+
+// biggest data frame, bigger writes are split
+const maxFrameDataLength = 16 * 1024 * 1024 /* 16MiB */
+
+// a frame received, which fields are set depend on kind
+type frame struct {
+	kind    byte
+	offset  int64
+	data    []byte
+	message string
+}
+
+/**
+ * Split "tcp://host:port" and "unix:///path" in a network and an address.
+ * isNetwork is false if path isn't one of them (it's a file path).
+ */
+func ParseNetworkAddress(path string) (network string, address string, isNetwork bool) {
+	for _, network = range []string{"tcp", "unix"} {
+		if strings.HasPrefix(path, network+"://") {
+			return network, strings.TrimPrefix(path, network+"://"), true
+		}
+	}
+	return "", "", false
+}
+
+/**
+ * Write the hello of a client: the magic, source (the name of its file on
+ * the receiver, see SourceFileName) and start, the stream offset of the first
+ * byte it send.
+ *
+ * Can return: nil, errorSourceTooLong or io errors
+ */
+func writeHello(writer io.Writer, source string, start int64) error {
+	if len(source) > 0xffff {
+		return errorSourceTooLong
+	}
+
+	hello := make([]byte, 0, len(protocolMagic)+2+len(source)+8)
+	hello = append(hello, protocolMagic...)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(source)))
+	hello = append(hello, source...)
+	hello = binary.BigEndian.AppendUint64(hello, uint64(start))
+
+	_, err := writer.Write(hello)
+	return err
+}
+
+/**
+ * Read the hello of a client and return its source name and start offset
+ * (StreamOffsetUnknown if the client doesn't know it).
+ *
+ * Can return: nil, errorBadMagic or io errors
+ */
+func readHello(reader io.Reader) (source string, start int64, err error) {
+	header := make([]byte, len(protocolMagic)+2)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return "", StreamOffsetUnknown, err
+	}
+	if string(header[:len(protocolMagic)]) != protocolMagic {
+		return "", StreamOffsetUnknown, errorBadMagic
+	}
+
+	sourceAndStart := make([]byte, int(binary.BigEndian.Uint16(header[len(protocolMagic):]))+8)
+	_, err = io.ReadFull(reader, sourceAndStart)
+	if err != nil {
+		return "", StreamOffsetUnknown, err
+	}
+
+	start = int64(binary.BigEndian.Uint64(sourceAndStart[len(sourceAndStart)-8:]))
+	if start < 0 {
+		start = StreamOffsetUnknown
+	}
+	return string(sourceAndStart[:len(sourceAndStart)-8]), start, nil
+}
+
+/**
+ * Write data, at offset in the stream, in a data frame (data must not be
+ * bigger than maxFrameDataLength).
+ *
+ * Can return: nil or io errors
+ */
+func writeDataFrame(writer io.Writer, offset int64, data []byte) error {
+	header := make([]byte, 0, 1+8+4)
+	header = append(header, frameData)
+	header = binary.BigEndian.AppendUint64(header, uint64(offset))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(data)))
+
+	_, err := writer.Write(append(header, data...))
+	return err
+}
+
+/**
+ * Write an ack frame: the bytes of the stream before offset are durable.
+ *
+ * Can return: nil or io errors
+ */
+func writeAckFrame(writer io.Writer, offset int64) error {
+	ack := make([]byte, 0, 1+8)
+	ack = append(ack, frameAck)
+	ack = binary.BigEndian.AppendUint64(ack, uint64(offset))
+
+	_, err := writer.Write(ack)
+	return err
+}
+
+/**
+ * Write an error frame, message is truncated to 65535 bytes.
+ *
+ * Can return: nil or io errors
+ */
+func writeErrorFrame(writer io.Writer, message string) error {
+	if len(message) > 0xffff {
+		message = message[:0xffff]
+	}
+
+	errorFrame := make([]byte, 0, 1+2+len(message))
+	errorFrame = append(errorFrame, frameError)
+	errorFrame = binary.BigEndian.AppendUint16(errorFrame, uint16(len(message)))
+	errorFrame = append(errorFrame, message...)
+
+	_, err := writer.Write(errorFrame)
+	return err
+}
+
+/**
+ * Write a busy frame: another connection is receiving the source.
+ *
+ * Can return: nil or io errors
+ */
+func writeBusyFrame(writer io.Writer) error {
+	_, err := writer.Write([]byte{frameBusy})
+	return err
+}
+
+/**
+ * Read a frame.
+ *
+ * Can return: nil, errorUnknownFrame, errorFrameTooBig or io errors
+ */
+func readFrame(reader io.Reader) (received frame, err error) {
+	kind := make([]byte, 1)
+	_, err = io.ReadFull(reader, kind)
+	if err != nil {
+		return received, err
+	}
+	received.kind = kind[0]
+
+	switch received.kind {
+	case frameData:
+		header := make([]byte, 8+4)
+		_, err = io.ReadFull(reader, header)
+		if err != nil {
+			return received, err
+		}
+		received.offset = int64(binary.BigEndian.Uint64(header[:8]))
+		length := binary.BigEndian.Uint32(header[8:])
+		if length > maxFrameDataLength {
+			return received, errorFrameTooBig
+		}
+		received.data = make([]byte, length)
+		_, err = io.ReadFull(reader, received.data)
+
+	case frameAck:
+		offset := make([]byte, 8)
+		_, err = io.ReadFull(reader, offset)
+		received.offset = int64(binary.BigEndian.Uint64(offset))
+
+	case frameError:
+		length := make([]byte, 2)
+		_, err = io.ReadFull(reader, length)
+		if err != nil {
+			return received, err
+		}
+		message := make([]byte, binary.BigEndian.Uint16(length))
+		_, err = io.ReadFull(reader, message)
+		received.message = string(message)
+
+	case frameBusy:
+
+	default:
+		return received, errorUnknownFrame
+	}
+
+	if err == io.EOF {
+		// the connection was closed in the middle of the frame
+		err = io.ErrUnexpectedEOF
+	}
+	return received, err
+}
+
+var errorSourceTooLong = errors.New("source name too long")
+var errorBadMagic = errors.New("bad protocol magic")
+var errorUnknownFrame = errors.New("unknown frame type")
+var errorFrameTooBig = errors.New("data frame too big")
@@ -0,0 +1,88 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestParseNetworkAddress(t *testing.T) {
+	testCases := []struct {
+		inputV           string
+		expectedNetwork  string
+		expectedAddress  string
+		expectedNetworkV bool
+	}{
+		{"tcp://localhost:1234", "tcp", "localhost:1234", true},
+		{"unix:///run/dd.sock", "unix", "/run/dd.sock", true},
+		{"/tmp/dump", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.inputV, func(t *testing.T) {
+			network, address, isNetwork := ParseNetworkAddress(tc.inputV)
+			if network != tc.expectedNetwork || address != tc.expectedAddress || isNetwork != tc.expectedNetworkV {
+				t.Errorf("got '%s' '%s' %v; expected '%s' '%s' %v",
+					network, address, isNetwork, tc.expectedNetwork, tc.expectedAddress, tc.expectedNetworkV)
+			}
+		})
+	}
+}
+
+func TestFrames(t *testing.T) {
+	stream := new(bytes.Buffer)
+
+	err := writeHello(stream, "host-app.log", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDataFrame(stream, 42, []byte("data"))
+	writeAckFrame(stream, 46)
+	writeErrorFrame(stream, "no space left")
+
+	source, start, err := readHello(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "host-app.log" {
+		t.Errorf("source, expected: 'host-app.log', got: '%s'", source)
+	}
+	if start != 42 {
+		t.Errorf("start, expected: 42, got: %d", start)
+	}
+
+	expectedFrames := []frame{
+		{kind: frameData, offset: 42, data: []byte("data")},
+		{kind: frameAck, offset: 46},
+		{kind: frameError, message: "no space left"},
+	}
+	for _, expected := range expectedFrames {
+		received, err := readFrame(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.kind != expected.kind || received.offset != expected.offset ||
+			!bytes.Equal(received.data, expected.data) || received.message != expected.message {
+			t.Errorf("got %+v; expected %+v", received, expected)
+		}
+	}
+
+	_, err = readFrame(stream)
+	if err != io.EOF {
+		t.Errorf("expected error %v, got: %v", io.EOF, err)
+	}
+
+	// truncated frame
+	writeDataFrame(stream, 0, []byte("data"))
+	stream.Truncate(stream.Len() - 1)
+	_, err = readFrame(stream)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected error %v, got: %v", io.ErrUnexpectedEOF, err)
+	}
+
+	_, _, err = readHello(bytes.NewBufferString("HTTP/1.1"))
+	if err != errorBadMagic {
+		t.Errorf("expected error %v, got: %v", errorBadMagic, err)
+	}
+}
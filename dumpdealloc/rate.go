@@ -0,0 +1,87 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/**
+ * Token bucket limiting the bytes per second.
+ * The bucket hold at most one second of tokens. A chunk bigger than the
+ * bucket is allowed and put it in debt, the next Wait pay the debt back.
+ */
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64 /* bytes per second, 0 means unlimited */
+	tokens float64
+	last   time.Time
+}
+
+// Change the rate (0 means unlimited)
+func (limiter *rateLimiter) SetRate(rate int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.rate = rate
+	limiter.tokens = 0
+	limiter.last = time.Now()
+}
+
+// Return the rate (0 means unlimited)
+func (limiter *rateLimiter) Rate() int64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.rate
+}
+
+/**
+ * Take n tokens, wait until the bucket isn't in debt anymore.
+ * Return early (without error) if ctx is done.
+ */
+func (limiter *rateLimiter) Wait(ctx context.Context, n int64) {
+	limiter.mutex.Lock()
+	if limiter.rate <= 0 {
+		limiter.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * float64(limiter.rate)
+	if limiter.tokens > float64(limiter.rate) {
+		limiter.tokens = float64(limiter.rate)
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	debt := time.Duration(-limiter.tokens / float64(limiter.rate) * float64(time.Second))
+	limiter.mutex.Unlock()
+
+	if debt <= 0 {
+		return
+	}
+	timer := time.NewTimer(debt)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,224 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Receiver side of the network output (dump-deallocate receive).
+ * Each source is written in its own file in dir, each data frame is written
+ * and made durable (fdatasync) before being acknowledged.
+ * The offset of a source is the size of its file, data frames already
+ * received (sent again after a reconnection or by a client resuming from its
+ * state) are acknowledged but not written again, so each byte is written
+ * exactly once.
+ * Only one connection at a time receive a source, the others are answered
+ * with a busy frame.
+ */
+type Receiver struct {
+	Logger *log.Logger /* the connections and their errors, nil: no output */
+
+	dir     string
+	mutex   sync.Mutex
+	sources map[string]net.Conn /* connection currently receiving each source */
+}
+
+func NewReceiver(dir string) *Receiver {
+	return &Receiver{dir: dir, sources: make(map[string]net.Conn)}
+}
+
+/**
+ * Accept connections on listener and handle them until listener is closed.
+ *
+ * Can return: nil or net errors
+ */
+func (recv *Receiver) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go recv.handle(conn)
+	}
+}
+
+/**
+ * Name of the file of source in the receiver directory.
+ * Characters other than letters, digits, '.', '_' and '-' are replaced by '_'.
+ *
+ * Can return: nil or errorBadSourceName
+ */
+func SourceFileName(source string) (string, error) {
+	fileName := strings.Map(func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9':
+			return char
+		case char == '.' || char == '_' || char == '-':
+			return char
+		}
+		return '_'
+	}, source)
+
+	if len(fileName) == 0 || strings.HasPrefix(fileName, ".") {
+		return "", errorBadSourceName
+	}
+	return fileName, nil
+}
+
+var errorBadSourceName = errors.New("bad source name")
+
+// Handle a connection from hello to close
+func (recv *Receiver) handle(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(netAckTimeout))
+	source, start, err := readHello(conn)
+	if err != nil {
+		logPrintf(recv.Logger, "receiver, %s: readHello err='%v'", remote, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	fileName, err := SourceFileName(source)
+	if err != nil {
+		logPrintf(recv.Logger, "receiver, %s: source '%s' err='%v'", remote, source, err)
+		writeErrorFrame(conn, err.Error())
+		return
+	}
+
+	// another client is writing the same source (or the previous connection
+	// of a client reconnecting isn't closed yet, it will try again)
+	recv.mutex.Lock()
+	if other, busy := recv.sources[fileName]; busy {
+		recv.mutex.Unlock()
+		logPrintf(recv.Logger, "receiver, %s: %s already received from %s", remote, fileName, other.RemoteAddr())
+		writeBusyFrame(conn)
+		return
+	}
+	recv.sources[fileName] = conn
+	recv.mutex.Unlock()
+
+	defer func() {
+		recv.mutex.Lock()
+		delete(recv.sources, fileName)
+		recv.mutex.Unlock()
+	}()
+
+	logPrintf(recv.Logger, "receiver, %s: receiving %s", remote, fileName)
+	offset, err := recv.receive(conn, filepath.Join(recv.dir, fileName), start)
+	if err != nil && err != io.EOF {
+		logPrintf(recv.Logger, "receiver, %s: %s at offset %d err='%v'", remote, fileName, offset, err)
+		writeErrorFrame(conn, err.Error())
+		return
+	}
+	logPrintf(recv.Logger, "receiver, %s: %s done at offset %d", remote, fileName, offset)
+}
+
+/**
+ * Write the data frames received on conn in the file path, until the
+ * connection is closed (io.EOF).
+ * start is the offset the client start from (StreamOffsetUnknown to start
+ * from the end of path), it can't be after the end of path.
+ * Return the offset (size of path) at the end.
+ *
+ * Can return: io.EOF, errorReceiveGap, errorStartBeyondEnd, os or net errors
+ */
+func (recv *Receiver) receive(conn net.Conn, path string, start int64) (offset int64, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// what we already have has to be durable before we tell the client
+	err = unix.Fdatasync(int(file.Fd()))
+	if err != nil {
+		return 0, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset = fileInfo.Size()
+
+	if start == StreamOffsetUnknown {
+		start = offset
+	}
+	if start > offset {
+		return offset, errorStartBeyondEnd
+	}
+	err = writeAckFrame(conn, start)
+	if err != nil {
+		return offset, err
+	}
+
+	for {
+		received, err := readFrame(conn)
+		if err != nil {
+			return offset, err
+		}
+		if received.kind != frameData {
+			return offset, errorUnknownFrame
+		}
+
+		if received.offset > offset {
+			return offset, errorReceiveGap
+		}
+
+		// skip the bytes already received (data sent again after a reconnection)
+		dataEnd := received.offset + int64(len(received.data))
+		if dataEnd > offset {
+			_, err = file.Write(received.data[offset-received.offset:])
+			if err != nil {
+				return offset, err
+			}
+			err = unix.Fdatasync(int(file.Fd()))
+			if err != nil {
+				return offset, err
+			}
+			offset = dataEnd
+		}
+
+		// the client may be resending what we have, don't ack more than it sent
+		err = writeAckFrame(conn, dataEnd)
+		if err != nil {
+			return offset, err
+		}
+	}
+}
+
+var errorReceiveGap = errors.New("data frame after the end of the received bytes")
+var errorStartBeyondEnd = errors.New("client start offset after the end of the received bytes")
@@ -0,0 +1,234 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSourceFileName(t *testing.T) {
+	testCases := []struct {
+		inputV    string
+		expectedV string
+		expectedE error
+	}{
+		{"host-app.log", "host-app.log", nil},
+		{"host-../../etc/passwd", "host-.._.._etc_passwd", nil},
+		{"../etc", "", errorBadSourceName},
+		{"", "", errorBadSourceName},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.inputV, func(t *testing.T) {
+			fileName, err := SourceFileName(tc.inputV)
+			if err != tc.expectedE {
+				t.Errorf("got error '%v'; expected error '%v'", err, tc.expectedE)
+			}
+			if fileName != tc.expectedV {
+				t.Errorf("got '%s'; expected '%s'", fileName, tc.expectedV)
+			}
+		})
+	}
+}
+
+// start a receiver on localhost, in a temporary directory
+func startReceiver(t *testing.T) (dir string, listener net.Listener) {
+	dir, err := ioutil.TempDir(".", "dump-deallocate-receive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewReceiver(dir).Serve(listener)
+	return dir, listener
+}
+
+func TestReceiver(t *testing.T) {
+	netReconnectMinDelay = time.Millisecond
+	defer func() { netReconnectMinDelay = 100 * time.Millisecond }()
+
+	dir, listener := startReceiver(t)
+	defer os.RemoveAll(dir)
+	defer listener.Close()
+
+	testContent := bytes.Repeat([]byte("dump-deallocate"), 10000)
+	half := len(testContent) / 2
+
+	output, err := DialNetOutput("tcp", listener.Addr().String(), "test", StreamOffsetUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for chunkStart := 0; chunkStart < half; chunkStart += 4096 {
+		chunkEnd := chunkStart + 4096
+		if chunkEnd > half {
+			chunkEnd = half
+		}
+		_, err = output.Write(testContent[chunkStart:chunkEnd])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// connection lost in the middle
+		if chunkStart == 8192 {
+			output.mutex.Lock()
+			output.conn.Close()
+			output.mutex.Unlock()
+		}
+	}
+	err = output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Close()
+
+	// a second run append to what the receiver has
+	output, err = DialNetOutput("tcp", listener.Addr().String(), "test", StreamOffsetUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = output.Write(testContent[half:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Close()
+
+	received, err := ioutil.ReadFile(filepath.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testContent, received) {
+		t.Errorf("received content differ from the sent one (%d bytes, expected %d)", len(received), len(testContent))
+	}
+}
+
+func TestReceiverDuplicateAndGap(t *testing.T) {
+	dir, listener := startReceiver(t)
+	defer os.RemoveAll(dir)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = writeHello(conn, "test", StreamOffsetUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectAck := func(expectedOffset int64) {
+		received, err := readFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.kind != frameAck || received.offset != expectedOffset {
+			t.Fatalf("got %+v; expected ack of %d", received, expectedOffset)
+		}
+	}
+
+	expectAck(0)
+
+	writeDataFrame(conn, 0, []byte("abc"))
+	expectAck(3)
+
+	// duplicate
+	writeDataFrame(conn, 0, []byte("abc"))
+	expectAck(3)
+
+	// overlap
+	writeDataFrame(conn, 1, []byte("bcde"))
+	expectAck(5)
+
+	// gap
+	writeDataFrame(conn, 10, []byte("xyz"))
+	received, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.kind != frameError {
+		t.Errorf("got %+v; expected an error frame", received)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "abcde" {
+		t.Errorf("got '%s'; expected 'abcde'", content)
+	}
+}
+
+func TestReceiverResume(t *testing.T) {
+	netBusyTimeout = 100 * time.Millisecond
+	defer func() { netBusyTimeout = 10 * time.Second }()
+
+	dir, listener := startReceiver(t)
+	defer os.RemoveAll(dir)
+	defer listener.Close()
+
+	testContent := bytes.Repeat([]byte("dump-deallocate"), 100)
+
+	output, err := DialNetOutput("tcp", listener.Addr().String(), "test", StreamOffsetUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = output.Write(testContent[:1000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another connection for the same source
+	_, err = DialNetOutput("tcp", listener.Addr().String(), "test", StreamOffsetUnknown)
+	if err != errorSourceBusy {
+		t.Errorf("expected error %v, got: %v", errorSourceBusy, err)
+	}
+	output.Close()
+
+	// restart from the state saved before the last commit, the bytes sent
+	// again aren't written twice
+	output, err = DialNetOutput("tcp", listener.Addr().String(), "test", 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = output.Write(testContent[600:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Durable() != int64(len(testContent)-600) {
+		t.Errorf("durable, expected: %d, got: %d", len(testContent)-600, output.Durable())
+	}
+	output.Close()
+
+	// the receiver doesn't have the bytes before start
+	_, err = DialNetOutput("tcp", listener.Addr().String(), "test", int64(len(testContent))+1)
+	if _, isReceiverError := err.(*errorReceiver); !isReceiverError {
+		t.Errorf("expected a receiver error, got: %v", err)
+	}
+
+	received, err := ioutil.ReadFile(filepath.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testContent, received) {
+		t.Errorf("received content differ from the sent one (%d bytes, expected %d)", len(received), len(testContent))
+	}
+}
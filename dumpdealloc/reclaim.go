@@ -0,0 +1,119 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+)
+
+/**
+ * Check that the punch-holes really return space to the filesystem.
+ * Some filesystems (FUSE, compression, …) accept FALLOC_FL_PUNCH_HOLE but
+ * don't free anything, so we compare st_blocks before and after the punch-holes.
+ *
+ * The decreases of st_blocks are measured around each punch-hole (instead
+ * of start vs end), so bytes appended to file during the dump (Options.Follow)
+ * don't hide them.
+ */
+type reclaimTracker struct {
+	file              *os.File
+	blocksStart       int64 /* st_blocks (512 bytes unit) before the dump */
+	blocksBeforePunch int64
+	byteExpected      int64 /* bytes freed according to the punch-holes (whole blocks) */
+	byteReclaimed     int64 /* bytes freed according to st_blocks */
+	blocksLast        int64 /* st_blocks of the last sample */
+	requireReclaim    bool  /* fail (ErrNothingReclaimed) instead of warning */
+	logger            *log.Logger
+	warned            bool
+}
+
+// check st_blocks decreased once the punch-holes should have freed this many bytes
+var reclaimCheckAfter int64 = 64 * 1024 * 1024 /* 64MiB */
+
+/**
+ * Create a reclaimTracker on file and sample its st_blocks.
+ * With requireReclaim, AfterPunch fails instead of warning on logger.
+ *
+ * Can return: nil or *os.PathError
+ */
+func newReclaimTracker(file *os.File, requireReclaim bool, logger *log.Logger) (tracker *reclaimTracker, err error) {
+	tracker = &reclaimTracker{file: file, requireReclaim: requireReclaim, logger: logger}
+	tracker.blocksStart, err = tracker.Blocks()
+	return tracker, err
+}
+
+/**
+ * Return the st_blocks of the tracked file.
+ *
+ * Can return: nil or *os.PathError
+ */
+func (tracker *reclaimTracker) Blocks() (int64, error) {
+	var fileInfo unix.Stat_t
+	err := unix.Fstat(int(tracker.file.Fd()), &fileInfo)
+	if err != nil {
+		return 0, &os.PathError{Op: "fstat", Path: tracker.file.Name(), Err: err}
+	}
+	tracker.blocksLast = fileInfo.Blocks
+	return fileInfo.Blocks, nil
+}
+
+/**
+ * To be called just before a punch-hole.
+ *
+ * Can return: nil or *os.PathError
+ */
+func (tracker *reclaimTracker) BeforePunch() (err error) {
+	tracker.blocksBeforePunch, err = tracker.Blocks()
+	return err
+}
+
+/**
+ * To be called just after a punch-hole which should have freed byteFreed bytes.
+ * Once reclaimCheckAfter bytes should have been freed, warn if st_blocks
+ * never decreased (or fail with requireReclaim).
+ *
+ * Can return: nil, *os.PathError or ErrNothingReclaimed
+ */
+func (tracker *reclaimTracker) AfterPunch(byteFreed int64) error {
+	blocks, err := tracker.Blocks()
+	if err != nil {
+		return err
+	}
+	blocksDecrease := tracker.blocksBeforePunch - blocks
+	if blocksDecrease > 0 {
+		tracker.byteReclaimed += blocksDecrease * 512
+	}
+	tracker.byteExpected += byteFreed
+
+	if tracker.warned || tracker.byteExpected < reclaimCheckAfter || tracker.byteReclaimed > 0 {
+		return nil
+	}
+	tracker.warned = true
+
+	if tracker.requireReclaim {
+		return ErrNothingReclaimed
+	}
+	logPrintf(tracker.logger, "warning: %d bytes punched but st_blocks didn't decrease, "+
+		"the filesystem of %s doesn't seem to free punched blocks", tracker.byteExpected, tracker.file.Name())
+	return nil
+}
@@ -0,0 +1,95 @@
+package dumpdealloc
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReclaimTracker(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestReclaimTracker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	fsBlockSize, err := FilesystemBlockSize(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(make([]byte, 4*fsBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker, err := newReclaimTracker(file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tracker.BeforePunch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byteFreed, err := PunchHole(file, 0, 2*fsBlockSize, fsBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tracker.AfterPunch(byteFreed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tracker.byteExpected != 2*fsBlockSize {
+		t.Errorf("expected, expected: %d, got: %d", 2*fsBlockSize, tracker.byteExpected)
+	}
+	if tracker.byteReclaimed != 2*fsBlockSize {
+		t.Errorf("reclaimed, expected: %d, got: %d", 2*fsBlockSize, tracker.byteReclaimed)
+	}
+}
+
+func TestReclaimTrackerNothingReclaimed(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestReclaimTrackerNothingReclaimed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	reclaimCheckAfter = 1
+	defer func() { reclaimCheckAfter = 64 * 1024 * 1024 }()
+
+	t.Run("warn", func(t *testing.T) {
+		// a punch-hole which "freed" 4096 bytes without changing st_blocks
+		tracker, err := newReclaimTracker(file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracker.BeforePunch()
+		err = tracker.AfterPunch(4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tracker.byteReclaimed != 0 || !tracker.warned {
+			t.Errorf("reclaimed and warned, expected: 0 true, got: %d %v", tracker.byteReclaimed, tracker.warned)
+		}
+	})
+
+	t.Run("require-reclaim", func(t *testing.T) {
+		tracker, err := newReclaimTracker(file, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracker.BeforePunch()
+		err = tracker.AfterPunch(4096)
+		if err != ErrNothingReclaimed {
+			t.Errorf("expected error %v, got: %v", ErrNothingReclaimed, err)
+		}
+	})
+}
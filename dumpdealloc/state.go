@@ -0,0 +1,208 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+/**
+ * Checkpoint of the dump progress (--state).
+ *
+ * The state file contain a single fixed width line:
+ *   <inode of FILE> <committed offset> <pending offset> <stream offset>
+ * - committed: all bytes before this offset have been written on output
+ * - pending:   bytes between committed and pending may have been written on output
+ *              (we were writing them when the previous run stopped)
+ * - stream:    offset of the byte at committed in the stream of the receiver
+ *              (--output tcp://…), -1 when unknown; a restarted run start from
+ *              there and the receiver doesn't write twice the bytes it has
+ *
+ * The line always has the same length and is written at offset 0 followed
+ * by fdatasync, so an interrupted update can't leave a half written line.
+ */
+type State struct {
+	stateFile *os.File
+	inode     uint64
+	committed int64
+	pending   int64
+	stream    int64
+}
+
+const stateLineFormat = "%020d %020d %020d %020d\n"
+const stateLineLength = 4*20 + 4
+
+/**
+ * Open (or create) the state file statePath for file.
+ * If the state file is new, committed and pending are 0.
+ *
+ * Can return: nil, os errors, errorStateCorrupted, errorStateOtherFile or errorStateBeyondEOF
+ */
+func OpenState(statePath string, file *os.File) (state *State, err error) {
+	var fileInfo unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &fileInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	stateFile, err := os.OpenFile(statePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	state = &State{stateFile: stateFile, inode: fileInfo.Ino, stream: StreamOffsetUnknown}
+
+	line := make([]byte, stateLineLength)
+	nbByteRead, err := stateFile.ReadAt(line, 0)
+	if err != nil && err != io.EOF {
+		stateFile.Close()
+		return nil, err
+	}
+
+	// new state file
+	if nbByteRead == 0 {
+		return state, nil
+	}
+
+	var inode uint64
+	_, err = fmt.Sscanf(string(line[:nbByteRead]), "%d %d %d %d\n", &inode, &state.committed, &state.pending, &state.stream)
+	if err != nil || state.committed < 0 || state.pending < state.committed || state.stream < StreamOffsetUnknown {
+		stateFile.Close()
+		return nil, errorStateCorrupted
+	}
+
+	if inode != state.inode {
+		stateFile.Close()
+		return nil, errorStateOtherFile
+	}
+
+	// FILE has been truncated or collapsed after the state was saved,
+	// committed doesn't mean anything anymore
+	if state.committed > fileInfo.Size {
+		stateFile.Close()
+		return nil, errorStateBeyondEOF
+	}
+
+	return state, nil
+}
+
+var errorStateCorrupted = errors.New("state file corrupted")
+var errorStateOtherFile = errors.New("state file belong to another file (inode differ)")
+var errorStateBeyondEOF = errors.New("state file offset is beyond the end of file")
+
+/**
+ * Return the committed and pending offsets.
+ * When pending > committed, the previous run stopped while writing the bytes
+ * between them: they may be on output twice.
+ */
+func (state *State) Offsets() (committed int64, pending int64) {
+	return state.committed, state.pending
+}
+
+// Return the stream offset of the committed byte (StreamOffsetUnknown if unknown)
+func (state *State) Stream() int64 {
+	return state.stream
+}
+
+/**
+ * Record the stream offset of the committed byte, StreamOffsetUnknown when
+ * the output isn't a receiver (or the stream isn't a copy of FILE, compressed).
+ *
+ * Can return: nil or *os.PathError
+ */
+func (state *State) SetStream(stream int64) error {
+	state.stream = stream
+	return state.save()
+}
+
+/**
+ * Record that bytes up to offset are about to be written on output.
+ *
+ * Can return: nil or *os.PathError
+ */
+func (state *State) Pending(offset int64) error {
+	state.pending = offset
+	return state.save()
+}
+
+/**
+ * Record that bytes up to offset have been written on output (and are durable).
+ * Bytes after offset which are pending stay pending. The stream offset (if
+ * known) move with committed.
+ *
+ * Can return: nil or *os.PathError
+ */
+func (state *State) Commit(offset int64) error {
+	if state.stream != StreamOffsetUnknown {
+		state.stream += offset - state.committed
+	}
+	state.committed = offset
+	if state.pending < offset {
+		state.pending = offset
+	}
+	return state.save()
+}
+
+/**
+ * Move committed and pending by delta bytes.
+ * Used after the end actions (collapse, truncate) which move the bytes of FILE
+ * (not the stream, the stream offset doesn't move).
+ *
+ * Can return: nil or *os.PathError
+ */
+func (state *State) Shift(delta int64) error {
+	state.committed += delta
+	state.pending += delta
+	if state.committed < 0 {
+		state.committed, state.pending = 0, 0
+	}
+	return state.save()
+}
+
+// write the state line and make it durable
+func (state *State) save() error {
+	line := fmt.Sprintf(stateLineFormat, state.inode, state.committed, state.pending, state.stream)
+
+	_, err := state.stateFile.WriteAt([]byte(line), 0)
+	if err != nil {
+		return err
+	}
+
+	err = unix.Fdatasync(int(state.stateFile.Fd()))
+	if err != nil {
+		return &os.PathError{Op: "fdatasync", Path: state.stateFile.Name(), Err: err}
+	}
+	return nil
+}
+
+func (state *State) Close() error {
+	return state.stateFile.Close()
+}
+
+// Close and remove the state file (used by EndRemove)
+func (state *State) Remove() error {
+	state.Close()
+	return os.Remove(state.stateFile.Name())
+}
@@ -0,0 +1,233 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestState-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write(make([]byte, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherFile, err := ioutil.TempFile(".", "dump-deallocate-TestState-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(otherFile.Name())
+	defer otherFile.Close()
+
+	statePath := file.Name() + ".state"
+	defer os.Remove(statePath)
+
+	// new state file
+	state, err := OpenState(statePath, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.committed != 0 || state.pending != 0 {
+		t.Errorf("new state, expected: 0 0, got: %d %d", state.committed, state.pending)
+	}
+
+	// interrupted between Pending and Commit
+	err = state.Commit(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.Pending(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+
+	state, err = OpenState(statePath, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.committed != 1024 || state.pending != 2048 {
+		t.Errorf("reopened state, expected: 1024 2048, got: %d %d", state.committed, state.pending)
+	}
+	if state.Stream() != StreamOffsetUnknown {
+		t.Errorf("stream, expected: %d, got: %d", StreamOffsetUnknown, state.Stream())
+	}
+
+	// the stream offset move with committed, not with Shift
+	err = state.SetStream(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.Commit(3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.Shift(-3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+
+	state, err = OpenState(statePath, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.committed != 0 || state.Stream() != 12048 {
+		t.Errorf("reopened state, expected: 0 12048, got: %d %d", state.committed, state.Stream())
+	}
+	err = state.Commit(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+
+	// state of another file
+	_, err = OpenState(statePath, otherFile)
+	if err != errorStateOtherFile {
+		t.Errorf("expected error %v, got: %v", errorStateOtherFile, err)
+	}
+
+	// FILE truncated after the state was saved
+	err = file.Truncate(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenState(statePath, file)
+	if err != errorStateBeyondEOF {
+		t.Errorf("expected error %v, got: %v", errorStateBeyondEOF, err)
+	}
+
+	// garbage
+	err = ioutil.WriteFile(statePath, []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenState(statePath, file)
+	if err != errorStateCorrupted {
+		t.Errorf("expected error %v, got: %v", errorStateCorrupted, err)
+	}
+}
+
+func TestDrainResume(t *testing.T) {
+	testContent, err := ioutil.ReadFile("../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeOffset := int64(len(testContent) / 3)
+
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainResume-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statePath := file.Name() + ".state"
+	defer os.Remove(statePath)
+	checkpoint, err := OpenState(statePath, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	err = checkpoint.Commit(resumeOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain resume at the committed offset
+	outputBuffer := new(bytes.Buffer)
+	result, err := Drain(context.Background(), file, outputBuffer, Options{Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileTotalByteDeallocated, outputTotalByteWritten := result.ByteDeallocated, result.ByteWritten
+
+	if !bytes.Equal(testContent[resumeOffset:], outputBuffer.Bytes()) {
+		t.Errorf("content hasn't been copied correctly, see '%s'", file.Name())
+	}
+	if fileTotalByteDeallocated != int64(len(testContent)) {
+		t.Errorf("deallocated, expected: '%v', got '%v'", len(testContent), fileTotalByteDeallocated)
+	}
+	if outputTotalByteWritten != int64(len(testContent))-resumeOffset {
+		t.Errorf("written, expected: '%v', got '%v'", int64(len(testContent))-resumeOffset, outputTotalByteWritten)
+	}
+	if checkpoint.committed != int64(len(testContent)) || checkpoint.pending != checkpoint.committed {
+		t.Errorf("state, expected: %d %d, got: %d %d",
+			len(testContent), len(testContent), checkpoint.committed, checkpoint.pending)
+	}
+}
+
+func TestDrainStateZeroCopy(t *testing.T) {
+	testContent, err := ioutil.ReadFile("../LICENSE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestDrainStateZeroCopy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statePath := file.Name() + ".state"
+	defer os.Remove(statePath)
+	checkpoint, err := OpenState(statePath, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+
+	// the chunks are moved by copy_file_range or sendfile
+	output, err := ioutil.TempFile(".", "dump-deallocate-TestDrainStateZeroCopy-output-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	result, err := Drain(context.Background(), file, output, Options{Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ZeroCopy) == 0 {
+		t.Skip("zero-copy not used")
+	}
+
+	// nothing is pending after a complete dump (the last copy moved nothing)
+	if checkpoint.committed != int64(len(testContent)) || checkpoint.pending != checkpoint.committed {
+		t.Errorf("state, expected: %d %d, got: %d %d",
+			len(testContent), len(testContent), checkpoint.committed, checkpoint.pending)
+	}
+}
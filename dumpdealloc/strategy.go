@@ -0,0 +1,225 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// how the dumped bytes of file are deallocated (Options.Strategy)
+type Strategy int
+
+const (
+	StrategyAuto       Strategy = iota /* the best one supported by the filesystem (see Probe) */
+	StrategyPunchHole                  /* fallocate punch-hole during the dump */
+	StrategyZeroRange                  /* fallocate zero-range during the dump, the filesystem may keep the blocks allocated */
+	StrategyCopyRename                 /* nothing during the dump, at the end the bytes not dumped are copied in a new file renamed over file */
+)
+
+// strategies accepted by --strategy, indexed by Strategy
+var StrategyNames = []string{"auto", "punch-hole", "zero-range", "copy-rename"}
+
+func (strategy Strategy) String() string {
+	if strategy < 0 || int(strategy) >= len(StrategyNames) {
+		return "unknown"
+	}
+	return StrategyNames[strategy]
+}
+
+/**
+ * Return the Strategy named name (one of StrategyNames).
+ *
+ * Can return: nil or ErrUnknownStrategy
+ */
+func ParseStrategy(name string) (Strategy, error) {
+	for strategy, strategyName := range StrategyNames {
+		if name == strategyName {
+			return Strategy(strategy), nil
+		}
+	}
+	return StrategyAuto, ErrUnknownStrategy
+}
+
+var ErrUnknownStrategy = errors.New("unknown deallocation strategy")
+
+/**
+ * Return the strategy Drain use for file: strategy, or for StrategyAuto
+ * punch-hole if file supports it (probed on file itself, without allocating
+ * anything, see probeFilePunchHole), copy-rename otherwise. zero-range is
+ * never chosen: it can't be probed without allocating blocks.
+ * Only an unsupported punch-hole (EOPNOTSUPP) leads to copy-rename, if the
+ * probe fails otherwise punch-hole is used, the dump reports the real errors.
+ * With requireReclaim, only punch-hole is accepted. The choice is logged on logger.
+ *
+ * Can return: nil or *StrategyError
+ */
+func chooseStrategy(file *os.File, strategy Strategy, requireReclaim bool, logger *log.Logger) (Strategy, error) {
+	if strategy == StrategyAuto {
+		supported, err := probeFilePunchHole(file)
+		switch {
+		case err != nil:
+			logPrintf(logger, "warning: probe of punch-hole on %s fail err='%v', using the punch-hole strategy", file.Name(), err)
+			strategy = StrategyPunchHole
+		case supported:
+			strategy = StrategyPunchHole
+		default:
+			strategy = StrategyCopyRename
+			logPrintf(logger, "warning: the filesystem of %s can't punch holes, using the %v strategy", file.Name(), strategy)
+		}
+	}
+
+	if requireReclaim && strategy != StrategyPunchHole {
+		return strategy, &StrategyError{Strategy: strategy, Err: errorNoReclaim}
+	}
+	return strategy, nil
+}
+
+var errorNoReclaim = errors.New("no block is freed during the dump")
+
+/**
+ * Deallocate the bytes of file between start and end with strategy
+ * (StrategyAuto is punch-hole). Return the number of bytes freed according
+ * to the strategy (see PunchHole, the other strategies free nothing).
+ *
+ * Can return: nil or *PunchError
+ */
+func deallocate(file *os.File, strategy Strategy, start int64, end int64, fsBlockSize int64) (byteFreed int64, err error) {
+	switch strategy {
+	case StrategyZeroRange:
+		return 0, ZeroRange(file, start, end)
+	case StrategyCopyRename:
+		// done at the end, see rewriteFrom
+		return 0, nil
+	}
+	return PunchHole(file, start, end, fsBlockSize)
+}
+
+/**
+ * Erase (fallocate zero-range) the bytes of file between start and end.
+ * Depending on the filesystem, their blocks are freed or kept allocated
+ * (as unwritten extents).
+ *
+ * Can return: nil or *PunchError
+ */
+func ZeroRange(file *os.File, start int64, end int64) error {
+	if end <= start {
+		return nil
+	}
+	err := unix.Fallocate(int(file.Fd()),
+		unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE,
+		start,
+		end-start)
+	if err != nil {
+		return &PunchError{Start: start, End: end, Err: err}
+	}
+	return nil
+}
+
+/**
+ * Remove the first offset bytes of file by copying the rest in a new file
+ * (in the same directory, with the same mode) renamed over file. The
+ * descriptor of file is then the one of the new file (dup3).
+ * file is locked (see fileLock) during the copy: if another process opens
+ * it, or if it grows, the new file is removed and ErrRewriteRefused returned.
+ * Return the number of bytes removed.
+ *
+ * Can return: nil, os errors or ErrRewriteRefused
+ */
+func rewriteFrom(file *os.File, offset int64) (byteRemoved int64, err error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+
+	lock, err := lockFile(file)
+	if err != nil {
+		return 0, ErrRewriteRefused
+	}
+	defer lock.Unlock()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fileInfo.Size()
+	if offset > size {
+		offset = size
+	}
+
+	newFile, err := ioutil.TempFile(filepath.Dir(file.Name()), "."+filepath.Base(file.Name())+".dump-deallocate-")
+	if err != nil {
+		return 0, err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(newFile.Name())
+		}
+		newFile.Close()
+	}()
+
+	err = newFile.Chmod(fileInfo.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	var fileStat unix.Stat_t
+	if unix.Fstat(int(file.Fd()), &fileStat) == nil {
+		// only possible as root, otherwise the new file is ours
+		unix.Fchown(int(newFile.Fd()), int(fileStat.Uid), int(fileStat.Gid))
+	}
+
+	_, err = io.Copy(newFile, io.NewSectionReader(file, offset, size-offset))
+	if err != nil {
+		return 0, err
+	}
+	err = newFile.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	// the bytes written in file meanwhile would be lost
+	fileInfo, err = file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !lock.Held() || fileInfo.Size() != size {
+		return 0, ErrRewriteRefused
+	}
+
+	err = os.Rename(newFile.Name(), file.Name())
+	if err != nil {
+		return 0, err
+	}
+	renamed = true
+
+	err = unix.Dup3(int(newFile.Fd()), int(file.Fd()), unix.O_CLOEXEC)
+	if err != nil {
+		return offset, &os.PathError{Op: "dup3", Path: file.Name(), Err: err}
+	}
+	return offset, nil
+}
+
+var ErrRewriteRefused = errors.New("the file has been opened or grew during its rewrite, copy-rename refused")
@@ -0,0 +1,19 @@
+package dumpdealloc
+
+import (
+	"testing"
+)
+
+func TestParseStrategy(t *testing.T) {
+	for index, name := range StrategyNames {
+		strategy, err := ParseStrategy(name)
+		if err != nil || strategy != Strategy(index) || strategy.String() != name {
+			t.Errorf("ParseStrategy(%s), expected: %d, got: %d (%v)", name, index, strategy, err)
+		}
+	}
+
+	_, err := ParseStrategy("punch")
+	if err != ErrUnknownStrategy {
+		t.Errorf("expected error %v, got: %v", ErrUnknownStrategy, err)
+	}
+}
@@ -0,0 +1,170 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+/**
+ * Exclusive lock of a file, so nobody writes in it during the end action.
+ * - "lease": write lease (F_SETLEASE), possible only if nobody else has the
+ *   file open, an open by another process is then blocked until the lease
+ *   is released (or the lease-break-time of the kernel ends).
+ * - "flock": advisory lock, only respected by cooperating writers.
+ * - "none": neither is supported.
+ */
+type fileLock struct {
+	file *os.File
+	Kind string
+}
+
+/**
+ * Lock file with a lease, or else flock.
+ *
+ * Can return: nil or errorFileLocked (another process holds a flock on file)
+ */
+func lockFile(file *os.File) (*fileLock, error) {
+	_, err := unix.FcntlInt(file.Fd(), unix.F_SETLEASE, unix.F_WRLCK)
+	if err == nil {
+		return &fileLock{file: file, Kind: "lease"}, nil
+	}
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return nil, errorFileLocked
+	}
+	if err == nil {
+		return &fileLock{file: file, Kind: "flock"}, nil
+	}
+	return &fileLock{file: file, Kind: "none"}, nil
+}
+
+// Return false if the lease has been broken (another process opened the file)
+func (lock *fileLock) Held() bool {
+	if lock.Kind != "lease" {
+		return true
+	}
+	lease, err := unix.FcntlInt(lock.file.Fd(), unix.F_GETLEASE, 0)
+	return err == nil && lease == unix.F_WRLCK
+}
+
+func (lock *fileLock) Unlock() {
+	switch lock.Kind {
+	case "lease":
+		unix.FcntlInt(lock.file.Fd(), unix.F_SETLEASE, unix.F_UNLCK)
+	case "flock":
+		unix.Flock(int(lock.file.Fd()), unix.LOCK_UN)
+	}
+}
+
+var errorFileLocked = errors.New("file locked by another process")
+
+// rounds of dump of the bytes appended while the lock is taken
+var truncateDrainAttempts = 3
+
+/**
+ * EndTruncate without losing the bytes appended to file after the end of the
+ * dump: at the end of file the lock is taken (see fileLock), the bytes
+ * appended meanwhile are dumped, then file is truncated only if its size is
+ * still the offset dumped. Otherwise file is left as is (dumped, with holes).
+ */
+type safeTruncater struct {
+	file     *os.File
+	lock     *fileLock
+	lockErr  error /* the truncate will be refused */
+	attempts int
+	released bool
+}
+
+func (truncater *safeTruncater) takeLock() {
+	if truncater.lock == nil && truncater.lockErr == nil {
+		truncater.lock, truncater.lockErr = lockFile(truncater.file)
+	}
+}
+
+/**
+ * Options.atEOF of CopyWhileDeallocate: take the lock and tell if bytes have
+ * been appended after offset (in which case the dump continue).
+ *
+ * Can return: nil or *os.PathError
+ */
+func (truncater *safeTruncater) atEOF(offset int64) (more bool, err error) {
+	truncater.takeLock()
+	if truncater.lockErr != nil || truncater.attempts >= truncateDrainAttempts {
+		return false, nil
+	}
+	truncater.attempts++
+
+	fileInfo, err := truncater.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return fileInfo.Size() > offset, nil
+}
+
+/**
+ * Truncate file to 0 if its size is offset (everything has been dumped), and
+ * release the lock.
+ *
+ * Can return: nil, *os.PathError or ErrTruncateRefused
+ */
+func (truncater *safeTruncater) truncate(offset int64) error {
+	truncater.takeLock()
+	defer truncater.release()
+	if truncater.lockErr != nil || !truncater.lock.Held() {
+		return ErrTruncateRefused
+	}
+
+	fileInfo, err := truncater.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() != offset {
+		return ErrTruncateRefused
+	}
+
+	err = unix.Ftruncate(int(truncater.file.Fd()), 0)
+	if err != nil {
+		return &os.PathError{Op: "truncate", Path: truncater.file.Name(), Err: err}
+	}
+	return nil
+}
+
+// Release the lock (if any)
+func (truncater *safeTruncater) release() {
+	if truncater.lock != nil && !truncater.released {
+		truncater.lock.Unlock()
+		truncater.released = true
+	}
+}
+
+// Kind of the lock taken ("" if none could be taken)
+func (truncater *safeTruncater) lockKind() string {
+	if truncater.lock == nil {
+		return ""
+	}
+	return truncater.lock.Kind
+}
+
+var ErrTruncateRefused = errors.New("the file is locked or grew during the truncate, truncate refused (holes left in place)")
@@ -0,0 +1,77 @@
+package dumpdealloc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSafeTruncaterAtEOF(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestSafeTruncaterAtEOF-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.Remove(file.Name())
+		}
+	}()
+	defer file.Close()
+
+	testContent := []byte("first part\n")
+	appendedContent := []byte("appended once the end of file is reached\n")
+	_, err = file.Write(testContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bytes appended between the end of file and the lock
+	truncater := &safeTruncater{file: file}
+	defer truncater.release()
+	appended := false
+	options := Options{
+		atEOF: func(offset int64) (bool, error) {
+			if !appended {
+				appended = true
+				_, err := file.WriteAt(appendedContent, offset)
+				if err != nil {
+					return false, err
+				}
+			}
+			return truncater.atEOF(offset)
+		},
+	}
+
+	outputBuffer := new(bytes.Buffer)
+	var result Result
+	err = CopyWhileDeallocate(context.Background(), file, outputBuffer, options, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedOutput := append(testContent, appendedContent...)
+	if !bytes.Equal(outputBuffer.Bytes(), expectedOutput) {
+		t.Errorf("output, expected: %q, got: %q", expectedOutput, outputBuffer.Bytes())
+	}
+	// nobody else has file open
+	if truncater.lockKind() != "lease" {
+		t.Errorf("lock, expected: lease, got: %s", truncater.lockKind())
+	}
+
+	err = truncater.truncate(result.ByteDeallocated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() != 0 {
+		t.Errorf("size, expected: 0, got: %d, see '%s'", fileInfo.Size(), file.Name())
+	}
+}
@@ -0,0 +1,244 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package dumpdealloc
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"time"
+)
+
+/**
+ * Write the chunks of file on an output file descriptor without copying them
+ * in a user-space buffer: copy_file_range or sendfile to a regular file,
+ * splice to a pipe, sendfile to anything else (socket, character device…).
+ * The read offset of file is used and moved, like a read.
+ * When a syscall can't be used (EINVAL, ENOSYS, EXDEV or EOPNOTSUPP), the next
+ * one is tried; once none remains copyChunk returns errorZeroCopy and the
+ * chunk has to go through a buffer. The other errors are the ones of the
+ * output (EPIPE, ENOSPC…).
+ *
+ * A pipe or a socket doesn't get a copy of the bytes but references to the
+ * pages of file: a punch-hole would zero them before they are read from the
+ * pipe (or sent). InFlight tells how many of the last bytes written are
+ * still in the pipe or the socket, they must not be deallocated yet.
+ */
+type zeroCopier struct {
+	output   *os.File
+	methods  []string        /* syscalls still to try, the first one is in use */
+	wrote    func(int) error /* accounting of the output (FileOutput), nil for *os.File */
+	inFlight uint            /* ioctl giving the bytes still in the output (0: none) */
+	used     string          /* last syscall which moved bytes */
+}
+
+// how often drain check the bytes still in the output, and how long it waits
+var zeroCopyDrainInterval = 10 * time.Millisecond
+var zeroCopyDrainTimeout = 60 * time.Second
+
+/**
+ * Create a zeroCopier on output, nil if output isn't backed by a file
+ * descriptor (compression, network output…).
+ */
+func newZeroCopier(output io.Writer) *zeroCopier {
+	copier := &zeroCopier{}
+	switch output := output.(type) {
+	case *os.File:
+		copier.output = output
+	case *FileOutput:
+		copier.output = output.file
+		copier.wrote = output.wrote
+	default:
+		return nil
+	}
+
+	var outputStat unix.Stat_t
+	err := unix.Fstat(int(copier.output.Fd()), &outputStat)
+	if err != nil {
+		return nil
+	}
+	switch outputStat.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		// copy_file_range (EBADF) and sendfile (EINVAL) refuse a file opened
+		// in append mode (>> or --append)
+		flags, err := unix.FcntlInt(copier.output.Fd(), unix.F_GETFL, 0)
+		if err != nil || flags&unix.O_APPEND != 0 {
+			return nil
+		}
+		copier.methods = []string{"copy_file_range", "sendfile"}
+	case unix.S_IFIFO:
+		copier.methods = []string{"splice"}
+		copier.inFlight = unix.TIOCINQ /* FIONREAD */
+	case unix.S_IFSOCK:
+		copier.methods = []string{"sendfile"}
+		copier.inFlight = unix.SIOCOUTQ
+	default:
+		copier.methods = []string{"sendfile"}
+	}
+
+	// without it we can't know when the pages of file are released
+	if copier.inFlight != 0 {
+		_, err = unix.IoctlGetInt(int(copier.output.Fd()), copier.inFlight)
+		if err != nil {
+			return nil
+		}
+	}
+	return copier
+}
+
+// Return false once no syscall can write on the output
+func (copier *zeroCopier) usable() bool {
+	return len(copier.methods) > 0
+}
+
+/**
+ * Return the number of bytes written on the output which may still
+ * reference the pages of file (in a pipe or a socket).
+ */
+func (copier *zeroCopier) bytesInFlight() int64 {
+	if copier.inFlight == 0 || len(copier.used) == 0 {
+		return 0
+	}
+	inFlight, err := unix.IoctlGetInt(int(copier.output.Fd()), copier.inFlight)
+	if err != nil {
+		// the output is gone (the reader closed the pipe…)
+		return 0
+	}
+	return int64(inFlight)
+}
+
+/**
+ * Wait until the output doesn't reference the pages of file anymore, until
+ * ctx is done or zeroCopyDrainTimeout. Return the bytes still in the output
+ * (they must not be deallocated).
+ *
+ * Can return: nil, ctx.Err(), unix.EPIPE (the reader is gone, the bytes left
+ * will never be read) or errorDrainTimeout
+ */
+func (copier *zeroCopier) drain(ctx context.Context) (inFlight int64, err error) {
+	deadline := time.Now().Add(zeroCopyDrainTimeout)
+	for {
+		inFlight = copier.bytesInFlight()
+		if inFlight == 0 {
+			return 0, nil
+		}
+		if copier.readerGone() {
+			return inFlight, unix.EPIPE
+		}
+		if time.Now().After(deadline) {
+			return inFlight, errorDrainTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return inFlight, ctx.Err()
+		case <-time.After(zeroCopyDrainInterval):
+		}
+	}
+}
+
+/**
+ * Return true if nobody reads the output anymore: the last reader of the
+ * pipe closed it, or the socket got an error or has been shut down (poll
+ * POLLERR or POLLHUP).
+ */
+func (copier *zeroCopier) readerGone() bool {
+	fds := []unix.PollFd{{Fd: int32(copier.output.Fd())}}
+	nbReady, err := unix.Poll(fds, 0)
+	if err != nil || nbReady == 0 {
+		return false
+	}
+	return fds[0].Revents&(unix.POLLERR|unix.POLLHUP) != 0
+}
+
+// wait until the output can be written, or fail (poll POLLOUT)
+func (copier *zeroCopier) waitWritable() {
+	fds := []unix.PollFd{{Fd: int32(copier.output.Fd()), Events: unix.POLLOUT}}
+	_, err := unix.Poll(fds, -1)
+	for err == unix.EINTR {
+		_, err = unix.Poll(fds, -1)
+	}
+}
+
+/**
+ * Move up to length bytes from the read offset of file to output, return the
+ * number of bytes moved (0 at the end of file).
+ *
+ * Can return: nil, errorZeroCopy (nothing moved), the errors of the output
+ * (syscall.Errno) or of its accounting (fdatasync of FileOutput)
+ */
+func (copier *zeroCopier) copyChunk(file *os.File, length int) (nbByteCopied int, err error) {
+	for len(copier.methods) > 0 {
+		nbByteCopied, err = copier.call(copier.methods[0], file, length)
+		for err == unix.EINTR || err == unix.EAGAIN {
+			if err == unix.EAGAIN {
+				// non-blocking output full
+				copier.waitWritable()
+			}
+			nbByteCopied, err = copier.call(copier.methods[0], file, length)
+		}
+		if !zeroCopyUnsupported(err) {
+			break
+		}
+		// this syscall can't do it, the next one may
+		copier.methods = copier.methods[1:]
+	}
+	if len(copier.methods) == 0 {
+		return 0, errorZeroCopy
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if nbByteCopied > 0 {
+		copier.used = copier.methods[0]
+		if copier.wrote != nil {
+			err = copier.wrote(nbByteCopied)
+		}
+	}
+	return nbByteCopied, err
+}
+
+func (copier *zeroCopier) call(method string, file *os.File, length int) (int, error) {
+	input, output := int(file.Fd()), int(copier.output.Fd())
+	switch method {
+	case "copy_file_range":
+		return unix.CopyFileRange(input, nil, output, nil, length, 0)
+	case "splice":
+		nbByteCopied, err := unix.Splice(input, nil, output, nil, length, unix.SPLICE_F_MOVE)
+		return int(nbByteCopied), err
+	}
+	return unix.Sendfile(output, input, nil, length)
+}
+
+// Return true if err means the syscall can't move bytes between these file descriptors
+func zeroCopyUnsupported(err error) bool {
+	switch err {
+	case unix.EINVAL, unix.ENOSYS, unix.EXDEV, unix.EOPNOTSUPP:
+		return true
+	}
+	return false
+}
+
+var errorZeroCopy = errors.New("no zero-copy syscall can write on the output")
+var errorDrainTimeout = errors.New("the output didn't consume the bytes written")
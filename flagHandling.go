@@ -24,14 +24,94 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // boolean corresponding to flags
-var collapse, collapseTest, truncate, remove bool
-var collapseDefault, collapseTestDefault, truncateDefault, removeDefault bool = false, false, false, false
+var collapse, truncate, remove bool
+var collapseDefault, truncateDefault, removeDefault bool = false, false, false
+
+// collapse the start of FILE during the dump (--collapse-every and --exclusive)
+var collapseEvery sizeType = 0
+var collapseEveryDefault sizeType = 0
+var exclusive bool
+var exclusiveDefault bool = false
+
+// how the dumped bytes of FILE are deallocated (--strategy)
+var strategyName string
+var strategyNameDefault string = "auto"
+
+// do the end action even if other processes have FILE open (--force)
+var force bool
+var forceDefault bool = false
+
+// follow mode (--follow and --idle-timeout)
+var follow bool
+var followDefault bool = false
+var idleTimeout time.Duration
+var idleTimeoutDefault time.Duration = 0
+
+// only dump FILE up to its size at the start (--snapshot)
+var snapshot bool
+var snapshotDefault bool = false
+
+// path of the state file (--state)
+var statePath string
+var statePathDefault string = ""
+
+// dump the leading hole of FILE instead of skipping it (--dump-leading-hole)
+var dumpLeadingHole bool
+var dumpLeadingHoleDefault bool = false
+
+// fail if the punch-holes don't free anything (--require-reclaim)
+var requireReclaim bool
+var requireReclaimDefault bool = false
+
+// output compression (--compress and --compress-level)
+var compressAlgorithm string
+var compressAlgorithmDefault string = ""
+var compressLevel int
+var compressLevelDefault int = dumpdealloc.DefaultCompressLevel
+
+// output file (--output, --append and --sync-every)
+var outputPath string
+var outputPathDefault string = ""
+var outputAppend bool
+var outputAppendDefault bool = false
+var syncEvery sizeType = 0 /* after each chunk */
+var syncEveryDefault sizeType = 0
+
+// chunks read ahead and punch-holes queued (--in-flight), 1 means one chunk at a time
+var inFlight int
+var inFlightDefault int = 1
+
+// keep the last BYTES written allocated (--punch-lag)
+var punchLag sizeType = 0
+var punchLagDefault sizeType = 0
+
+// bytes and punch-holes per second limits (--rate and --max-ops), 0 means unlimited
+var rateLimit sizeType = 0
+var rateLimitDefault sizeType = 0
+var maxOps int64
+var maxOpsDefault int64 = 0
+
+// progress line on stderr (--progress) and JSON progress events (--progress-fd)
+var progressLine bool
+var progressLineDefault bool = false
+var progressFd int
+var progressFdDefault int = -1 /* disabled */
+
+// format of the summary printed on stderr at exit (--summary), "" for none
+var summaryFormat string
+var summaryFormatDefault string = ""
+
+// control socket of the dump (--control-socket)
+var controlSocket string
+var controlSocketDefault string = ""
 
 // sizeType is used for --buffer-size
 type sizeType int64
@@ -131,9 +211,70 @@ func (sizeObj *sizeType) Set(sizeStr string) (err error) {
 	return nil
 }
 
+/**
+ * Return the dumpdealloc.Options corresponding to the flags.
+ * Checkpoint (--state) and Hooks are set by the caller.
+ */
+func OptionsFromFlags() dumpdealloc.Options {
+	endAction := dumpdealloc.EndNone
+	if collapse {
+		endAction = dumpdealloc.EndCollapse
+	} else if truncate {
+		endAction = dumpdealloc.EndTruncate
+	} else if remove {
+		endAction = dumpdealloc.EndRemove
+	}
+
+	// checked by PostParsingCheckFlags
+	strategy, _ := dumpdealloc.ParseStrategy(strategyName)
+
+	return dumpdealloc.Options{
+		BufferSize:      int64(bufferSize),
+		Follow:          follow,
+		IdleTimeout:     idleTimeout,
+		DumpLeadingHole: dumpLeadingHole,
+		RequireReclaim:  requireReclaim,
+		PunchLag:        int64(punchLag),
+		InFlight:        inFlight,
+		Rate:            int64(rateLimit),
+		MaxOps:          maxOps,
+		Snapshot:        snapshot,
+		Force:           force,
+		CollapseEvery:   int64(collapseEvery),
+		Exclusive:       exclusive,
+		Strategy:        strategy,
+		EndAction:       endAction,
+	}
+}
+
+// Transform a boolean into integer
+func BoolToInt(boolean bool) int {
+	if boolean {
+		return 1
+	}
+	return 0
+}
+
 var errorNegativeOrZero = errors.New("negative or zero value")
 var errorInt64Overflow = errors.New("value too big to fit in int64")
 
+// flags of the receive subcommand (--listen and --dir)
+var receiveFlags = flag.NewFlagSet("receive", flag.ContinueOnError)
+var receiveListen string
+var receiveListenDefault string = ""
+var receiveDir string
+var receiveDirDefault string = "."
+
+// flags of the probe subcommand (--json)
+var probeFlags = flag.NewFlagSet("probe", flag.ContinueOnError)
+var probeJSON bool
+var probeJSONDefault bool = false
+
+// flags of the ctl subcommand (--control-socket)
+var ctlFlags = flag.NewFlagSet("ctl", flag.ContinueOnError)
+var ctlSocket string
+var ctlSocketDefault string = ""
+
 func init() {
 	// bufferSize
 	flag.Var(&bufferSize, "bufferSize", "")
@@ -143,11 +284,6 @@ func init() {
 	flag.BoolVar(&collapse, "collapse", collapseDefault, "")
 	flag.BoolVar(&collapse, "c", collapseDefault, "")
 
-	// collapseTest
-	collapseTestDefault := false
-	flag.BoolVar(&collapseTest, "collapse-test", collapseTestDefault, "")
-	flag.BoolVar(&collapseTest, "C", collapseTestDefault, "")
-
 	// truncate
 	truncateDefault := false
 	flag.BoolVar(&truncate, "truncate", truncateDefault, "")
@@ -158,15 +294,206 @@ func init() {
 	flag.BoolVar(&remove, "remove", removeDefault, "")
 	flag.BoolVar(&remove, "r", removeDefault, "")
 
+	// collapseEvery
+	flag.Var(&collapseEvery, "collapse-every", "")
+	flag.Var(&collapseEvery, "e", "")
+
+	// exclusive
+	flag.BoolVar(&exclusive, "exclusive", exclusiveDefault, "")
+	flag.BoolVar(&exclusive, "x", exclusiveDefault, "")
+
+	// strategyName
+	flag.StringVar(&strategyName, "strategy", strategyNameDefault, "")
+	flag.StringVar(&strategyName, "m", strategyNameDefault, "")
+
+	// force
+	flag.BoolVar(&force, "force", forceDefault, "")
+	flag.BoolVar(&force, "y", forceDefault, "")
+
+	// follow
+	flag.BoolVar(&follow, "follow", followDefault, "")
+	flag.BoolVar(&follow, "f", followDefault, "")
+
+	// idleTimeout
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeoutDefault, "")
+	flag.DurationVar(&idleTimeout, "i", idleTimeoutDefault, "")
+
+	// snapshot
+	flag.BoolVar(&snapshot, "snapshot", snapshotDefault, "")
+	flag.BoolVar(&snapshot, "n", snapshotDefault, "")
+
+	// statePath
+	flag.StringVar(&statePath, "state", statePathDefault, "")
+	flag.StringVar(&statePath, "s", statePathDefault, "")
+
+	// dumpLeadingHole
+	flag.BoolVar(&dumpLeadingHole, "dump-leading-hole", dumpLeadingHoleDefault, "")
+	flag.BoolVar(&dumpLeadingHole, "z", dumpLeadingHoleDefault, "")
+
+	// requireReclaim
+	flag.BoolVar(&requireReclaim, "require-reclaim", requireReclaimDefault, "")
+	flag.BoolVar(&requireReclaim, "R", requireReclaimDefault, "")
+
+	// compressAlgorithm
+	flag.StringVar(&compressAlgorithm, "compress", compressAlgorithmDefault, "")
+	flag.StringVar(&compressAlgorithm, "Z", compressAlgorithmDefault, "")
+
+	// compressLevel
+	flag.IntVar(&compressLevel, "compress-level", compressLevelDefault, "")
+	flag.IntVar(&compressLevel, "L", compressLevelDefault, "")
+
+	// outputPath
+	flag.StringVar(&outputPath, "output", outputPathDefault, "")
+	flag.StringVar(&outputPath, "o", outputPathDefault, "")
+
+	// outputAppend
+	flag.BoolVar(&outputAppend, "append", outputAppendDefault, "")
+	flag.BoolVar(&outputAppend, "a", outputAppendDefault, "")
+
+	// syncEvery
+	flag.Var(&syncEvery, "sync-every", "")
+	flag.Var(&syncEvery, "S", "")
+
+	// inFlight
+	flag.IntVar(&inFlight, "in-flight", inFlightDefault, "")
+	flag.IntVar(&inFlight, "q", inFlightDefault, "")
+
+	// punchLag
+	flag.Var(&punchLag, "punch-lag", "")
+	flag.Var(&punchLag, "P", "")
+
+	// rateLimit
+	flag.Var(&rateLimit, "rate", "")
+	flag.Var(&rateLimit, "B", "")
+
+	// maxOps
+	flag.Int64Var(&maxOps, "max-ops", maxOpsDefault, "")
+	flag.Int64Var(&maxOps, "O", maxOpsDefault, "")
+
+	// progressLine
+	flag.BoolVar(&progressLine, "progress", progressLineDefault, "")
+	flag.BoolVar(&progressLine, "p", progressLineDefault, "")
+
+	// progressFd
+	flag.IntVar(&progressFd, "progress-fd", progressFdDefault, "")
+	flag.IntVar(&progressFd, "F", progressFdDefault, "")
+
+	// summaryFormat
+	flag.StringVar(&summaryFormat, "summary", summaryFormatDefault, "")
+	flag.StringVar(&summaryFormat, "j", summaryFormatDefault, "")
+
+	// controlSocket
+	flag.StringVar(&controlSocket, "control-socket", controlSocketDefault, "")
+	flag.StringVar(&controlSocket, "k", controlSocketDefault, "")
+
+	// receiveListen
+	receiveFlags.StringVar(&receiveListen, "listen", receiveListenDefault, "")
+	receiveFlags.StringVar(&receiveListen, "l", receiveListenDefault, "")
+
+	// receiveDir
+	receiveFlags.StringVar(&receiveDir, "dir", receiveDirDefault, "")
+	receiveFlags.StringVar(&receiveDir, "d", receiveDirDefault, "")
+
+	receiveFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s receive -l ADDR [-d DIR]\n"+
+				" Receive the dumps sent by dump-deallocate -o tcp://… or -o unix://…\n"+
+				" Each source is appended to its own file in DIR, named after the source\n"+
+				" (<hostname>-<FILE base name>-<id>, the id being a hash of the absolute\n"+
+				" path, device and inode of FILE). Each chunk is made durable (fdatasync)\n"+
+				" before being acknowledged, chunks received twice (after a reconnection\n"+
+				" or from a run resuming from its --state) are acknowledged but written\n"+
+				" only once. A source is received by a single connection at a time, the\n"+
+				" other connections are refused.\n"+
+				" Stop on SIGINT/SIGTERM.\n\n"+
+
+				"Options:\n"+
+				" -l, --listen ADDR\n"+
+				"        Listen on ADDR: tcp://HOST:PORT, unix:///SOCKET or HOST:PORT.\n\n"+
+
+				" -d, --dir DIR\n"+
+				"        Directory where the sources files are written (default: .).\n",
+			os.Args[0])
+	}
+
+	// ctlSocket
+	ctlFlags.StringVar(&ctlSocket, "control-socket", ctlSocketDefault, "")
+	ctlFlags.StringVar(&ctlSocket, "k", ctlSocketDefault, "")
+
+	ctlFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s ctl -k SOCKET COMMAND [ARG]\n"+
+				" Send COMMAND to a dump started with --control-socket SOCKET and print\n"+
+				" its reply.\n\n"+
+
+				"Commands:\n"+
+				" status            offset of FILE dumped, bytes written, bytes reclaimed,\n"+
+				"                   rate (bytes/s), rate limit and state\n"+
+				" pause             pause the dump after the current chunk\n"+
+				" resume            resume a paused dump\n"+
+				" set-rate BYTES    limit the dump to BYTES per second (0: unlimited),\n"+
+				"                   BYTES accept the suffixes of --buffer-size\n"+
+				" stop-after-chunk  stop the dump after the current chunk (like SIGINT)\n\n"+
+
+				"Options:\n"+
+				" -k, --control-socket SOCKET\n"+
+				"        Control socket of the dump.\n",
+			os.Args[0])
+	}
+
+	// probeJSON
+	probeFlags.BoolVar(&probeJSON, "json", probeJSONDefault, "")
+	probeFlags.BoolVar(&probeJSON, "j", probeJSONDefault, "")
+
+	probeFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s probe [-j] [PATH]\n"+
+				" Probe the filesystem of PATH (a directory, or the directory of a file,\n"+
+				" default: .) on a temporary file created and removed in it, and report:\n"+
+				"  - the filesystem type and block size\n"+
+				"  - if it supports fallocate punch-hole, zero-range and collapse-range,\n"+
+				"    lseek SEEK_DATA/SEEK_HOLE, ioctl FIEMAP, O_DIRECT and leases\n"+
+				"  - which deallocation strategies (see --strategy) are safe on it, and\n"+
+				"    the one chosen by auto\n"+
+				" Exit status 1 if the probe can't be done.\n\n"+
+
+				"Options:\n"+
+				" -j, --json\n"+
+				"        Print the report as a JSON object, on one line:\n"+
+				"          {\"path\":…,\"filesystem\":…,\"block_size\":…,\"punch_hole\":…,\n"+
+				"           \"zero_range\":…,\"collapse_range\":…,\"seek_hole\":…,\"fiemap\":…,\n"+
+				"           \"o_direct\":…,\"lease\":…,\"strategies\":[{\"strategy\":…,\n"+
+				"           \"safe\":…,\"reason\":…}…],\"auto_strategy\":…}\n",
+			os.Args[0])
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage: %s [-b BYTES] [-c|-t|-r] FILE\n"+
+			"Usage: %s [-b BYTES] [-q CHUNKS] [-f [-i DURATION]|-n] [-s STATE|-z] [-R]\n"+
+				"          [-Z ALGO [-L LEVEL]] [-o PATH [-a] [-S BYTES]] [-P BYTES] [-m STRATEGY]\n"+
+				"          [-e BYTES [-x]] [-B BYTES] [-O OPS] [-p] [-F FD] [-j json] [-k SOCKET]\n"+
+				"          [-c|-t|-r [-y]] FILE\n"+
+				"       %[1]s receive -l ADDR [-d DIR]  (see %[1]s receive -h)\n"+
+				"       %[1]s ctl -k SOCKET COMMAND [ARG]  (see %[1]s ctl -h)\n"+
+				"       %[1]s probe [-j] [PATH]  (see %[1]s probe -h)\n"+
 				" Dump FILE on stdout and deallocate it at the same time.\n"+
 				" More precisely:\n"+
 				"   1. read BYTES bytes from FILE\n"+
 				"   2. write thoses bytes on stdout\n"+
 				"   3. deallocate BYTES bytes from FILE (fallocate punch-hole)\n"+
-				"      and go back to 1.\n\n"+
+				"      and go back to 1.\n"+
+				" The punch-holes are aligned on filesystem blocks (a partial block doesn't\n"+
+				" free anything), the tail of a chunk is deallocated with the next one.\n"+
+				" The dump start at the first data byte of FILE (past the zeros of its first\n"+
+				" data block): its leading hole is considered already dumped and\n"+
+				" deallocated (by a previous interrupted run).\n"+
+				" If the filesystem of FILE can't punch holes, another strategy is used\n"+
+				" (see --strategy).\n"+
+				" When the output is a pipe, a socket or a regular file (not in append\n"+
+				" mode), the bytes are moved by the kernel (splice, sendfile or\n"+
+				" copy_file_range) instead of going through the buffer, which stays the\n"+
+				" fallback. The last chunks written on a pipe or a socket stay in FILE\n"+
+				" if the reader goes away (or doesn't read for 60s) before reading them.\n\n"+
 
 				"Options:\n"+
 				" -b, --buffer-size BYTES\n"+
@@ -183,55 +510,411 @@ func init() {
 				"           …\n"+
 				"           - EB = 1000⁶\n\n"+
 
+				" -q, --in-flight CHUNKS\n"+
+				"        Read up to CHUNKS chunks of FILE ahead of the writes and queue up\n"+
+				"        to CHUNKS punch-holes, in goroutines: a slow output doesn't stall\n"+
+				"        the reads of FILE and a slow disk doesn't stall the output.\n"+
+				"        Each chunk has its own buffer (CHUNKS × --buffer-size of memory),\n"+
+				"        so the output doesn't use splice, sendfile or copy_file_range.\n"+
+				"        The punch-holes are still done in order, once the chunks are\n"+
+				"        written. Default 1: read, write and deallocate one chunk at a\n"+
+				"        time. Not accepted with -e.\n\n"+
+
+				" -R, --require-reclaim\n"+
+				"        Fail if the punch-holes don't return space to the filesystem\n"+
+				"        (st_blocks of FILE doesn't decrease), instead of only warning.\n"+
+				"        Checked after the first 64MiB punched and at the end of the dump.\n\n"+
+
+				" -Z, --compress ALGO\n"+
+				"        Compress the dump (%[3]s) before writing it on stdout.\n"+
+				"        Each chunk is flushed to stdout before being deallocated from FILE,\n"+
+				"        a compression failure stops the dump before the punch-hole.\n"+
+				"        With xz a flush ends the xz stream, so it is only flushed (and the\n"+
+				"        chunks deallocated) once the dictionary size is written (8MiB with\n"+
+				"        the default level, see --compress-level): the punch-holes trail\n"+
+				"        the writes by up to this size.\n\n"+
+
+				" -L, --compress-level LEVEL\n"+
+				"        Compression level (%[4]s).\n"+
+				"        By default use the default level of ALGO.\n\n"+
+
+				" -o, --output PATH\n"+
+				"        Write the dump in the file PATH (created, it must not exist) instead\n"+
+				"        of stdout. The written bytes are made durable (fdatasync) before\n"+
+				"        being deallocated from FILE.\n"+
+				"        PATH can also be tcp://HOST:PORT or unix:///SOCKET to send the dump\n"+
+				"        to a receiver (see dump-deallocate receive), the bytes are deallocated\n"+
+				"        once the receiver acknowledges them. On connection loss, reconnect\n"+
+				"        and send again the bytes not acknowledged.\n\n"+
+
+				" -a, --append\n"+
+				"        With --output file, append to PATH (created if needed).\n"+
+				"        A receiver always appends.\n\n"+
+
+				" -S, --sync-every BYTES\n"+
+				"        With --output file, only fdatasync PATH once BYTES have been written\n"+
+				"        since the last fdatasync (default: after each chunk).\n"+
+				"        FILE is deallocated up to the last fdatasync.\n\n"+
+
+				" -P, --punch-lag BYTES\n"+
+				"        Keep the last BYTES written allocated in FILE: the deallocation\n"+
+				"        trails the write position by BYTES, for outputs which buffer\n"+
+				"        before persisting (gzip pipe, remote shipper, …).\n"+
+				"        The window is deallocated at the end of the whole dump. On error\n"+
+				"        it stays in FILE and the safe resume offset is printed.\n\n"+
+
+				" -m, --strategy STRATEGY\n"+
+				"        How the dumped bytes are deallocated:\n"+
+				"         - punch-hole: fallocate punch-hole, the blocks are freed during\n"+
+				"           the dump.\n"+
+				"         - zero-range: fallocate zero-range, the bytes are erased during\n"+
+				"           the dump but, depending on the filesystem, their blocks stay\n"+
+				"           allocated until the end action.\n"+
+				"         - copy-rename: nothing is deallocated during the dump, at the end\n"+
+				"           the bytes not dumped are copied in a new file (next to FILE,\n"+
+				"           same mode) renamed over FILE, like --collapse. Refused (FILE\n"+
+				"           left as is, exit status 1) if FILE is opened or grows meanwhile.\n"+
+				"         - auto (default): before reading anything, probe punch-hole on\n"+
+				"           FILE itself (a block after its end, nothing is allocated) and\n"+
+				"           use punch-hole, or copy-rename if the filesystem doesn't\n"+
+				"           support it (punch-hole if the probe fails otherwise).\n"+
+				"        --require-reclaim only accepts punch-hole.\n\n"+
+
+				" -e, --collapse-every BYTES\n"+
+				"        During the dump, once BYTES at the start of FILE are deallocated,\n"+
+				"        remove them (fallocate collapse-range) so the size of FILE stays\n"+
+				"        small. Only if no other process has FILE open (write lease),\n"+
+				"        otherwise retried after the next chunk. Incompatible with --state.\n\n"+
+
+				" -x, --exclusive\n"+
+				"        With --collapse-every, promise that no other process has FILE open,\n"+
+				"        collapse without checking it.\n\n"+
+
+				" -B, --rate BYTES\n"+
+				"        Limit the dump to BYTES per second (token bucket, bursts of one\n"+
+				"        second), to spare the disk of FILE. BYTES accept the suffixes of\n"+
+				"        --buffer-size, use a buffer size smaller than BYTES.\n"+
+				"        By default unlimited. Changeable with dump-deallocate ctl set-rate.\n\n"+
+
+				" -O, --max-ops OPS\n"+
+				"        Limit the punch-holes (fallocate calls) to OPS per second.\n"+
+				"        By default unlimited.\n\n"+
+
+				" -p, --progress\n"+
+				"        Print on stderr, refreshed every second, the bytes of FILE dumped,\n"+
+				"        the size of FILE, the bytes reclaimed, the throughput and the ETA.\n\n"+
+
+				" -F, --progress-fd FD\n"+
+				"        Write progress events on the file descriptor FD (already open, ex:\n"+
+				"        3>progress.json), one JSON object per line, every second:\n"+
+				"          {\"event\":\"progress\",\"offset\":…,\"bytes_collapsed\":…,\n"+
+				"           \"bytes_written\":…,\"bytes_reclaimed\":…,\"file_size\":…,\n"+
+				"           \"rate\":…,\"eta_seconds\":…,\"elapsed_seconds\":…}\n"+
+				"        rate is in bytes per second, eta_seconds is -1 when unknown.\n"+
+				"        offset and file_size are the ones of FILE after the collapses\n"+
+				"        (--collapse-every).\n"+
+				"        The last event, at the end of the dump, is \"end\".\n\n"+
+
+				" -j, --summary json\n"+
+				"        At exit, print on stderr (last line) the result of the run as a\n"+
+				"        JSON object: file, initial_size, bytes_read, bytes_written,\n"+
+				"        bytes_punched, bytes_reclaimed, end_action, end_action_result (done,\n"+
+				"        failed, refused, skipped or none), end_lock (lease, flock or none),\n"+
+				"        openers (pid and command of the processes having FILE open),\n"+
+				"        strategy (punch-hole, zero-range or copy-rename), zero_copy\n"+
+				"        (splice, sendfile or copy_file_range, if the output didn't go\n"+
+				"        through the buffer),\n"+
+				"        bytes_collapsed, final_size, final_blocks (st_blocks),\n"+
+				"        duration_seconds, exit_code, exit_class (ok, failure, modified, read,\n"+
+				"        write, punch, collapse or interrupted), error and, if FILE may have\n"+
+				"        been partially dumped, safe_resume_offset.\n\n"+
+
+				" -k, --control-socket SOCKET\n"+
+				"        Listen on the unix socket SOCKET for the commands of\n"+
+				"        dump-deallocate ctl: status, pause, resume, set-rate and\n"+
+				"        stop-after-chunk. SOCKET is removed at the end.\n\n"+
+
 				" -c, --collapse\n"+
 				"        At the end of the whole dump, remove/collapse (with fallocate collapse-range)\n"+
 				"        the greatest number of filesystem blocks already dumped.\n"+
 				"        On normal condition, at the end, FILE will size one filesystem block.\n\n"+
 
-				"        Supported on ext4 from Linux 3.15.\n\n"+
-
-				" -C, --collapse-test\n"+
-				"        Test the collapse functionnality.\n"+
-				"        Create a file named dump-deallocate-collapse-test-<random str>\n"+
-				"        in the working directory and try to collapse it.\n"+
-				"        Remove file after the test.\n\n"+
+				"        Supported on ext4 from Linux 3.15 (see %[1]s probe). If the\n"+
+				"        filesystem can't collapse, the bytes not dumped are copied in a new\n"+
+				"        file renamed over FILE (see the copy-rename strategy), FILE then\n"+
+				"        only keeps them.\n\n"+
 
 				" -t, --truncate\n"+
-				"        Truncate FILE (to size 0) at the end of the whole dump\n"+
-				"        It is not recommended since another process can write in FILE between\n"+
-				"        the last read and the truncate call.\n"+
+				"        Truncate FILE (to size 0) at the end of the whole dump.\n"+
+				"        At the end of FILE, it is locked (write lease if nobody else has it\n"+
+				"        open, otherwise flock), the bytes appended meanwhile are dumped, then\n"+
+				"        FILE is truncated only if its size is still the offset dumped.\n"+
+				"        Otherwise (or if another process holds a flock on FILE) the truncate\n"+
+				"        is refused and FILE left dumped with its holes (exit status 1).\n"+
 				"        On normal condition, at the end, FILE will size 0.\n\n"+
 
 				" -r, --remove\n"+
-				"        Remove FILE at the end of the whole dump\n"+
-				"        It is not recommended since another process might be using FILE.\n\n"+
+				"        Remove FILE at the end of the whole dump.\n\n"+
+
+				" -y, --force\n"+
+				"        Do the end action (-c, -t, -r) even if other processes have FILE\n"+
+				"        open. By default, the processes having FILE open are searched\n"+
+				"        (in /proc/*/fd, and with a write lease attempt which also sees the\n"+
+				"        processes of other users), then printed and the end action is\n"+
+				"        refused: FILE is left dumped with its holes (exit status 1).\n\n"+
+
+				" -f, --follow\n"+
+				"        Don't stop at the end of FILE, wait for new bytes to be appended\n"+
+				"        and dump/deallocate them (like tail -f).\n"+
+				"        Stop on SIGINT/SIGTERM or after the idle timeout.\n"+
+				"        The end of the whole dump is then the moment the follow stops.\n"+
+				"        If FILE is truncated below the offset dumped (copytruncate…), the\n"+
+				"        dump fails and the end action is skipped.\n\n"+
+
+				" -i, --idle-timeout DURATION\n"+
+				"        With --follow, stop if FILE hasn't grown for DURATION (ex: 30s, 5m).\n"+
+				"        By default wait forever.\n\n"+
+
+				" -n, --snapshot\n"+
+				"        Only dump FILE up to the size it had at the start, the bytes appended\n"+
+				"        during the dump are left in FILE. The end action only concern this\n"+
+				"        range: --collapse only remove dumped blocks, --truncate and --remove\n"+
+				"        are refused if FILE grew.\n\n"+
+
+				" -s, --state STATE\n"+
+				"        Record in the STATE file the offset of FILE up to which bytes have\n"+
+				"        been written on stdout (updated and synced after each chunk).\n"+
+				"        If STATE already exist, resume the dump from this offset instead\n"+
+				"        of the start of FILE, and report the chunk which may have been\n"+
+				"        dumped twice if the previous run was interrupted.\n"+
+				"        Use a big buffer size, each chunk cost two fdatasync on STATE.\n"+
+				"        The leading hole of FILE isn't skipped, STATE offset is used instead.\n"+
+				"        With -o tcp://… or unix://… (without -Z), STATE also record the\n"+
+				"        offset in the stream of the receiver: the chunk dumped twice is\n"+
+				"        written only once by the receiver.\n\n"+
+
+				" -z, --dump-leading-hole\n"+
+				"        Dump the leading hole of FILE (as zeros) instead of skipping it.\n"+
+				"        Use it if FILE is a sparse file which hasn't been partially dumped.\n\n"+
+
+				"Exit status:\n"+
+				" 0  success\n"+
+				" 1  FILE untouched (bad option, can't open…), or FILE dumped but the\n"+
+				"    end of the dump (output flush, truncate, remove…) fail\n"+
+				" 2  FILE may have been modified (unexpected error)\n"+
+				" 3  fail to read FILE, it may have been modified\n"+
+				" 4  fail to write the dump on the output, FILE may have been modified\n"+
+				" 5  fail to deallocate FILE, it may have been modified\n"+
+				" 6  FILE dumped but collapse fail (2 during the dump, --collapse-every)\n"+
+				" 130  interrupted by SIGINT/SIGTERM (without --follow): the current\n"+
+				"    chunk is dumped and deallocated, the end action (-c, -t, -r) is\n"+
+				"    skipped and the resume offset printed\n"+
+				" On 2 to 5, the safe resume offset is printed: the bytes of FILE after\n"+
+				" it haven't been deallocated.\n\n"+
 
 				"Example: dump-deallocate big.log | gzip > small.gz\n",
-			os.Args[0], int64(bufferSize)/1024)
+			os.Args[0], int64(bufferSize)/1024,
+			strings.Join(dumpdealloc.CompressAlgorithms, ", "), compressLevelsUsage())
+	}
+}
+
+// Levels accepted by --compress-level for each algorithm: "gzip: 1-9, …"
+func compressLevelsUsage() string {
+	var levelsUsage []string
+	for _, algorithm := range dumpdealloc.CompressAlgorithms {
+		levels := dumpdealloc.CompressLevels[algorithm]
+		levelsUsage = append(levelsUsage, fmt.Sprintf("%s: %d-%d", algorithm, levels[0], levels[1]))
 	}
+	return strings.Join(levelsUsage, ", ")
 }
 
 /**
  * Verify some conditions on flags after the parsing.
- * Can return: nil, errorMissingFile, errorHaveFile or errorMutuallyExclusive
+ * Can return: nil, errorMissingFile, errorMutuallyExclusive,
+ * errorIdleTimeoutWithoutFollow, errorNegativeIdleTimeout, errorSnapshotAndFollow,
+ * errorStateAndLeadingHole, dumpdealloc.ErrUnknownCompression, errorCompressLevel,
+ * errorCompressLevelWithoutCompress,
+ * errorOutputOptionWithoutOutput, errorNegativeMaxOps, errorProgressFd,
+ * errorSummaryFormat, errorCollapseEveryAndState, errorExclusiveWithoutCollapseEvery,
+ * errorInFlight, errorCollapseEveryAndInFlight or dumpdealloc.ErrUnknownStrategy
  */
 func PostParsingCheckFlags() error {
 
-	if flag.NArg() != 1 && !collapseTest {
+	if flag.NArg() != 1 {
 		return errorMissingFile
 	}
 
-	if flag.NArg() != 0 && collapseTest {
-		return errorHaveFile
+	if BoolToInt(collapse)+BoolToInt(truncate)+BoolToInt(remove) > 1 {
+		return errorMutuallyExclusive
 	}
 
-	if BoolToInt(collapse)+BoolToInt(collapseTest)+BoolToInt(truncate)+BoolToInt(remove) > 1 {
-		return errorMutuallyExclusive
+	if idleTimeout != 0 && !follow {
+		return errorIdleTimeoutWithoutFollow
+	}
+
+	if idleTimeout < 0 {
+		return errorNegativeIdleTimeout
+	}
+
+	if snapshot && follow {
+		return errorSnapshotAndFollow
+	}
+
+	if len(statePath) != 0 && dumpLeadingHole {
+		return errorStateAndLeadingHole
+	}
+
+	if len(compressAlgorithm) != 0 {
+		known := false
+		for _, algorithm := range dumpdealloc.CompressAlgorithms {
+			known = known || algorithm == compressAlgorithm
+		}
+		if !known {
+			return dumpdealloc.ErrUnknownCompression
+		}
+		levels := dumpdealloc.CompressLevels[compressAlgorithm]
+		if compressLevel != compressLevelDefault && (compressLevel < levels[0] || compressLevel > levels[1]) {
+			return errorCompressLevel
+		}
+	} else if compressLevel != compressLevelDefault {
+		return errorCompressLevelWithoutCompress
+	}
+
+	_, _, isNetworkOutput := dumpdealloc.ParseNetworkAddress(outputPath)
+	if (len(outputPath) == 0 || isNetworkOutput) && (outputAppend || syncEvery != syncEveryDefault) {
+		return errorOutputOptionWithoutOutput
+	}
+
+	if maxOps < 0 {
+		return errorNegativeMaxOps
+	}
+
+	// stdout is the dump without --output
+	if progressFd != progressFdDefault && (progressFd < 1 || (progressFd == 1 && len(outputPath) == 0)) {
+		return errorProgressFd
+	}
+
+	if summaryFormat != summaryFormatDefault && summaryFormat != "json" {
+		return errorSummaryFormat
+	}
+
+	if collapseEvery != collapseEveryDefault && len(statePath) != 0 {
+		return errorCollapseEveryAndState
+	}
+
+	if exclusive && collapseEvery == collapseEveryDefault {
+		return errorExclusiveWithoutCollapseEvery
+	}
+
+	if inFlight < 1 {
+		return errorInFlight
+	}
+
+	if collapseEvery != collapseEveryDefault && inFlight > 1 {
+		return errorCollapseEveryAndInFlight
+	}
+
+	if _, err := dumpdealloc.ParseStrategy(strategyName); err != nil {
+		return err
 	}
 
 	return nil
 }
 
+/**
+ * Verify some conditions on the receive subcommand flags after the parsing.
+ * Can return: nil, errorMissingListen or errorReceiveArgument
+ */
+func PostParsingCheckReceiveFlags() error {
+
+	if len(receiveListen) == 0 {
+		return errorMissingListen
+	}
+
+	if receiveFlags.NArg() != 0 {
+		return errorReceiveArgument
+	}
+
+	return nil
+}
+
+/**
+ * Verify the probe subcommand arguments after the parsing.
+ * Return the path to probe (default: .).
+ * Can return: nil or errorProbeArgument
+ */
+func PostParsingCheckProbeFlags() (path string, err error) {
+
+	switch probeFlags.NArg() {
+	case 0:
+		return ".", nil
+	case 1:
+		return probeFlags.Arg(0), nil
+	}
+	return "", errorProbeArgument
+}
+
+/**
+ * Verify the ctl subcommand flags and arguments after the parsing.
+ * Return the command line to send, with the argument of set-rate in bytes.
+ * Can return: nil, errorMissingControlSocket, errorCtlCommand or sizeType errors
+ */
+func PostParsingCheckCtlFlags() (command string, err error) {
+
+	if len(ctlSocket) == 0 {
+		return "", errorMissingControlSocket
+	}
+
+	arguments := ctlFlags.Args()
+	if len(arguments) == 0 {
+		return "", errorCtlCommand
+	}
+
+	switch arguments[0] {
+	case "status", "pause", "resume", "stop-after-chunk":
+		if len(arguments) != 1 {
+			return "", errorCtlCommand
+		}
+		return arguments[0], nil
+	case "set-rate":
+		if len(arguments) != 2 {
+			return "", errorCtlCommand
+		}
+		// 0 means unlimited
+		if arguments[1] == "0" {
+			return "set-rate 0", nil
+		}
+		var rate sizeType
+		err = rate.Set(arguments[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("set-rate %d", int64(rate)), nil
+	}
+	return "", errorCtlCommand
+}
+
+var errorMissingControlSocket = errors.New("ctl requires -k")
+var errorCtlCommand = errors.New("ctl requires a command: status, pause, resume, set-rate BYTES or stop-after-chunk")
+
+var errorProbeArgument = errors.New("probe accepts only one PATH")
+
+var errorMissingListen = errors.New("receive requires -l")
+var errorReceiveArgument = errors.New("receive doesn't accept parameter")
+
 var errorMissingFile = errors.New("missing file parameter")
-var errorHaveFile = errors.New("-C doesn't accept file parameter")
-var errorMutuallyExclusive = errors.New("-c, -C, -t and -r are mutually exclusive")
+var errorMutuallyExclusive = errors.New("-c, -t and -r are mutually exclusive")
+var errorIdleTimeoutWithoutFollow = errors.New("-i requires -f")
+var errorNegativeIdleTimeout = errors.New("-i doesn't accept negative duration")
+var errorSnapshotAndFollow = errors.New("-n and -f are mutually exclusive")
+var errorStateAndLeadingHole = errors.New("-s and -z are mutually exclusive")
+var errorCompressLevel = errors.New("-L out of range for this compression algorithm")
+var errorCompressLevelWithoutCompress = errors.New("-L requires -Z")
+var errorOutputOptionWithoutOutput = errors.New("-a and -S require -o with a file")
+var errorNegativeMaxOps = errors.New("-O doesn't accept negative value")
+var errorCollapseEveryAndState = errors.New("-e and -s are mutually exclusive")
+var errorExclusiveWithoutCollapseEvery = errors.New("-x requires -e")
+var errorInFlight = errors.New("-q requires at least 1 chunk")
+var errorCollapseEveryAndInFlight = errors.New("-e doesn't accept -q greater than 1")
+var errorSummaryFormat = errors.New("-j only accept json")
+var errorProgressFd = errors.New("-F requires a file descriptor open for writing other than stdin (and stdout without -o)")
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
 	"strconv"
 	"strings"
 	"testing"
@@ -14,6 +15,21 @@ func TestDefaultBufferSize(t *testing.T) {
 	}
 }
 
+func TestBoolToInt(t *testing.T) {
+
+	t.Run("true", func(t *testing.T) {
+		if returnV := BoolToInt(true); returnV != 1 {
+			t.Errorf("got '%v'; expected '%v'", returnV, 1)
+		}
+	})
+
+	t.Run("false", func(t *testing.T) {
+		if returnV := BoolToInt(false); returnV != 0 {
+			t.Errorf("got '%v'; expected '%v'", returnV, 0)
+		}
+	})
+}
+
 func TestBufferSizeParsing(t *testing.T) {
 	bufferSize := new(sizeType)
 
@@ -65,23 +81,99 @@ func TestPostParsingCheckFlags(t *testing.T) {
 		expectedE error
 	}{
 		{[]string{"test"},             nil},
-		{[]string{"-C"},               nil},
 		{[]string{"-c", "test"},       nil},
 		{[]string{"-t", "test"},       nil},
 		{[]string{"-r", "test"},       nil},
-		{[]string{"-C", "test"},       errorHaveFile},
 		{[]string{"-c"},               errorMissingFile},
 		{[]string{"-t"},               errorMissingFile},
 		{[]string{"-r"},               errorMissingFile},
 		{[]string{"-c", "-t", "test"}, errorMutuallyExclusive},
 		{[]string{"-c", "-r", "test"}, errorMutuallyExclusive},
 		{[]string{"-t", "-r", "test"}, errorMutuallyExclusive},
+		{[]string{"-f", "test"},       nil},
+		{[]string{"-f", "-i", "1s", "test"}, nil},
+		{[]string{"-i", "1s", "test"}, errorIdleTimeoutWithoutFollow},
+		{[]string{"-f", "-i", "-1s", "test"}, errorNegativeIdleTimeout},
+		{[]string{"-n", "-t", "test"}, nil},
+		{[]string{"-r", "-y", "test"}, nil},
+		{[]string{"-e", "1GiB", "-x", "test"}, nil},
+		{[]string{"-e", "1GiB", "-s", "state", "test"}, errorCollapseEveryAndState},
+		{[]string{"-x", "test"}, errorExclusiveWithoutCollapseEvery},
+		{[]string{"-m", "zero-range", "test"}, nil},
+		{[]string{"--strategy", "punch", "test"}, dumpdealloc.ErrUnknownStrategy},
+		{[]string{"-n", "-f", "test"}, errorSnapshotAndFollow},
+		{[]string{"-s", "state", "test"}, nil},
+		{[]string{"-z", "test"},       nil},
+		{[]string{"-s", "state", "-z", "test"}, errorStateAndLeadingHole},
+		{[]string{"-R", "test"},       nil},
+		{[]string{"-Z", "gzip", "test"}, nil},
+		{[]string{"-Z", "zstd", "-L", "19", "test"}, nil},
+		{[]string{"-Z", "xz", "-L", "0", "test"}, nil},
+		{[]string{"-Z", "bzip2", "test"}, dumpdealloc.ErrUnknownCompression},
+		{[]string{"-Z", "gzip", "-L", "19", "test"}, errorCompressLevel},
+		{[]string{"-L", "1", "test"},  errorCompressLevelWithoutCompress},
+		{[]string{"-Z", "gzip", "-L", "0", "test"}, errorCompressLevel},
+		{[]string{"-L", "0", "test"},  errorCompressLevelWithoutCompress},
+		{[]string{"-o", "out", "-a", "-S", "1MiB", "test"}, nil},
+		{[]string{"-a", "test"},       errorOutputOptionWithoutOutput},
+		{[]string{"-S", "1MiB", "test"}, errorOutputOptionWithoutOutput},
+		{[]string{"-o", "tcp://localhost:1234", "test"}, nil},
+		{[]string{"-o", "unix:///run/dd.sock", "-a", "test"}, errorOutputOptionWithoutOutput},
+		{[]string{"-P", "1MiB", "test"}, nil},
+		{[]string{"-k", "/run/dd.sock", "test"}, nil},
+		{[]string{"-B", "50MiB", "-O", "100", "test"}, nil},
+		{[]string{"-O", "-1", "test"}, errorNegativeMaxOps},
+		{[]string{"-p", "-F", "3", "test"}, nil},
+		{[]string{"-F", "0", "test"}, errorProgressFd},
+		{[]string{"-F", "1", "test"}, errorProgressFd},
+		{[]string{"-o", "out", "-F", "1", "test"}, nil},
+		{[]string{"--summary=json", "test"}, nil},
+		{[]string{"-j", "yaml", "test"}, errorSummaryFormat},
+		{[]string{"-q", "8", "test"},  nil},
+		{[]string{"--in-flight", "0", "test"}, errorInFlight},
+		{[]string{"-e", "1GiB", "-q", "1", "test"}, nil},
+		{[]string{"-e", "1GiB", "-q", "4", "test"}, errorCollapseEveryAndInFlight},
 	}
 
+	// don't leave flags set for the other tests
+	defer func() {
+		collapse, truncate, remove = collapseDefault, truncateDefault, removeDefault
+		follow, idleTimeout = followDefault, idleTimeoutDefault
+		snapshot = snapshotDefault
+		force = forceDefault
+		collapseEvery, exclusive = collapseEveryDefault, exclusiveDefault
+		strategyName = strategyNameDefault
+		statePath, dumpLeadingHole = statePathDefault, dumpLeadingHoleDefault
+		requireReclaim = requireReclaimDefault
+		compressAlgorithm, compressLevel = compressAlgorithmDefault, compressLevelDefault
+		outputPath, outputAppend, syncEvery = outputPathDefault, outputAppendDefault, syncEveryDefault
+		punchLag = punchLagDefault
+		inFlight = inFlightDefault
+		controlSocket = controlSocketDefault
+		rateLimit, maxOps = rateLimitDefault, maxOpsDefault
+		progressLine, progressFd = progressLineDefault, progressFdDefault
+		summaryFormat = summaryFormatDefault
+	}()
+
 	for _, tc := range testCases {
 		t.Run(strings.Join(tc.inputV, " "), func(t *testing.T) {
 			// reset the flags
-			collapse, collapseTest, truncate, remove = collapseDefault, collapseTestDefault, truncateDefault, removeDefault
+			collapse, truncate, remove = collapseDefault, truncateDefault, removeDefault
+			follow, idleTimeout = followDefault, idleTimeoutDefault
+			snapshot = snapshotDefault
+			force = forceDefault
+			collapseEvery, exclusive = collapseEveryDefault, exclusiveDefault
+			strategyName = strategyNameDefault
+			statePath, dumpLeadingHole = statePathDefault, dumpLeadingHoleDefault
+			requireReclaim = requireReclaimDefault
+			compressAlgorithm, compressLevel = compressAlgorithmDefault, compressLevelDefault
+			outputPath, outputAppend, syncEvery = outputPathDefault, outputAppendDefault, syncEveryDefault
+			punchLag = punchLagDefault
+			inFlight = inFlightDefault
+			controlSocket = controlSocketDefault
+			rateLimit, maxOps = rateLimitDefault, maxOpsDefault
+			progressLine, progressFd = progressLineDefault, progressFdDefault
+			summaryFormat = summaryFormatDefault
 
 			// parse the input
 			flag.CommandLine.Parse(tc.inputV)
@@ -93,3 +185,95 @@ func TestPostParsingCheckFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestPostParsingCheckReceiveFlags(t *testing.T) {
+	testCases := []struct {
+		inputV    []string
+		expectedE error
+	}{
+		{[]string{"-l", "tcp://localhost:7070"},                nil},
+		{[]string{"-l", "localhost:7070", "-d", "/srv"},        nil},
+		{[]string{"-d", "/srv"},                                errorMissingListen},
+		{[]string{"-l", "localhost:7070", "test"},              errorReceiveArgument},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.inputV, " "), func(t *testing.T) {
+			// reset the flags
+			receiveListen, receiveDir = receiveListenDefault, receiveDirDefault
+
+			receiveFlags.Parse(tc.inputV)
+
+			err := PostParsingCheckReceiveFlags()
+			if err != tc.expectedE {
+				t.Errorf("expected error: %v, got: %v", tc.expectedE, err)
+			}
+		})
+	}
+}
+
+func TestPostParsingCheckProbeFlags(t *testing.T) {
+	testCases := []struct {
+		inputV    []string
+		expectedV string
+		expectedE error
+	}{
+		{[]string{},                     ".",    nil},
+		{[]string{"-j", "/srv"},         "/srv", nil},
+		{[]string{"--json", "/srv/log"}, "/srv/log", nil},
+		{[]string{"/srv", "/tmp"},       "",     errorProbeArgument},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.inputV, " "), func(t *testing.T) {
+			// reset the flags
+			probeJSON = probeJSONDefault
+
+			probeFlags.Parse(tc.inputV)
+
+			path, err := PostParsingCheckProbeFlags()
+			if err != tc.expectedE {
+				t.Errorf("expected error: %v, got: %v", tc.expectedE, err)
+			}
+			if path != tc.expectedV {
+				t.Errorf("got '%v'; expected '%v'", path, tc.expectedV)
+			}
+		})
+	}
+}
+
+func TestPostParsingCheckCtlFlags(t *testing.T) {
+	testCases := []struct {
+		inputV    []string
+		expectedV string
+		expectedE error
+	}{
+		{[]string{"-k", "dd.sock", "status"},                   "status",            nil},
+		{[]string{"-k", "dd.sock", "set-rate", "10MiB"},        "set-rate 10485760", nil},
+		{[]string{"-k", "dd.sock", "set-rate", "0"},            "set-rate 0",        nil},
+		{[]string{"-k", "dd.sock", "stop-after-chunk"},         "stop-after-chunk",  nil},
+		{[]string{"status"},                                    "",                  errorMissingControlSocket},
+		{[]string{"-k", "dd.sock"},                             "",                  errorCtlCommand},
+		{[]string{"-k", "dd.sock", "pause", "now"},             "",                  errorCtlCommand},
+		{[]string{"-k", "dd.sock", "set-rate"},                 "",                  errorCtlCommand},
+		{[]string{"-k", "dd.sock", "set-rate", "-1"},           "",                  errorNegativeOrZero},
+		{[]string{"-k", "dd.sock", "restart"},                  "",                  errorCtlCommand},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.inputV, " "), func(t *testing.T) {
+			// reset the flags
+			ctlSocket = ctlSocketDefault
+
+			ctlFlags.Parse(tc.inputV)
+
+			command, err := PostParsingCheckCtlFlags()
+			if err != tc.expectedE {
+				t.Errorf("expected error: %v, got: %v", tc.expectedE, err)
+			}
+			if command != tc.expectedV {
+				t.Errorf("got '%v'; expected '%v'", command, tc.expectedV)
+			}
+		})
+	}
+}
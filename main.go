@@ -21,46 +21,80 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
 	"golang.org/x/sys/unix"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 )
 
+// exit codes
+const (
+	exitOk       = 0
+	exitFailure  = 1 /* FILE untouched, or dumped but the end of the dump fail */
+	exitModified = 2 /* FILE may have been modified */
+	exitRead     = 3 /* fail to read FILE */
+	exitWrite    = 4 /* fail to write the dump on the output */
+	exitPunch    = 5 /* fail to deallocate (punch-hole) FILE */
+	exitCollapse = 6 /* dumped but fail to collapse FILE */
+
+	exitInterrupted = 130 /* interrupted by SIGINT/SIGTERM, FILE dumped up to the resume offset */
+)
+
+// where dumpdealloc logs its warnings, like our own logs
+var libraryLogger = log.New(os.Stderr, "", log.LstdFlags)
+
 func main() { os.Exit(mainWithExitCode()) }
 func mainWithExitCode() (exitCode int) {
 	var err error
-	var printIfPanic string
 	var file *os.File
-	exitCode = 0
+	exitCode = exitOk
+	// --summary, written after the recover below
+	summary := newRunSummary()
+	defer func() {
+		if summaryFormat == "json" {
+			summary.write(os.Stderr, exitCode, err)
+		}
+	}()
 	defer func() {
 		if r := recover(); r != nil {
-			if len(printIfPanic) != 0 {
-				log.Print(printIfPanic)
-			}
-			exitCode = 2
+			// a bug: FILE may be half dumped, say where it happened
+			log.Printf("panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+			exitCode = exitModified
 		}
 	}()
 
+	// a closed pipe on stdout is a write error (EPIPE) with a summary, not a silent death
+	signal.Ignore(unix.SIGPIPE)
+
+	if len(os.Args) > 1 && os.Args[1] == "receive" {
+		return mainReceive(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		return mainCtl(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		return mainProbe(os.Args[2:])
+	}
+
 	flag.Parse()
+	summary.File = flag.Arg(0)
 
 	// check if flags are correct
 	err = PostParsingCheckFlags()
 	if err != nil {
 		log.Print(flag.Arg(0), " untouched")
 		log.Printf("main, PostParsingCheckFlags err='%v'", err)
-		return 1
-	}
-
-	if collapseTest { // --collapse-test
-		err = TestCollapse()
-		if err != nil {
-			fmt.Println("Collapse test : FAIL")
-			return 1
-		}
-		fmt.Println("Collapse test : OK")
-		return 0
+		return exitFailure
 	}
 
 	// open source file
@@ -68,57 +102,392 @@ func mainWithExitCode() (exitCode int) {
 	if err != nil {
 		log.Print(flag.Arg(0), " untouched")
 		log.Printf("main, os.OpenFile err='%v'", err)
-		return 1
+		return exitFailure
 	}
 	defer file.Close()
+	summary.stat(file, true)
 
-	// main function
-	printIfPanic = fmt.Sprint(flag.Arg(0), " may have been modified")
-	fileTotalByteDeallocated, _ := CopyWhileDeallocate(file, os.Stdout)
-
-	if collapse { // --collapse
+	options := OptionsFromFlags()
+	options.Logger = libraryLogger
 
-		printIfPanic = fmt.Sprint(flag.Arg(0), " dumped but collapse fail")
+	if len(statePath) != 0 { // --state
+		var checkpoint *dumpdealloc.State
+		checkpoint, err = dumpdealloc.OpenState(statePath, file)
+		if err != nil {
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, OpenState err='%v'", err)
+			return exitFailure
+		}
+		defer checkpoint.Close()
 
-		// we can't collapse the whole file, so we make sure to keep at
-		// least one byte
-		_, err = CollapseFileStart(file, fileTotalByteDeallocated-1)
-		if err != unix.EOPNOTSUPP {
-			log.Print(flag.Arg(0), " dumped but collapse fail")
-			log.Printf("main, CollapseFileStart err='%v'", err)
-			return 1
+		committed, pending := checkpoint.Offsets()
+		if pending > committed {
+			log.Printf("%s: previous run stopped while dumping bytes %d to %d, they may have been dumped twice",
+				flag.Arg(0), committed, pending)
 		}
+		options.Checkpoint = checkpoint
+	}
 
-	} else if truncate { // --truncate
+	// where the dump is written
+	var output io.Writer = os.Stdout
+	// nil for stdout
+	var outputSink dumpdealloc.DurableWriter
+	var outputNet *dumpdealloc.NetOutput
+	if network, address, isNetwork := dumpdealloc.ParseNetworkAddress(outputPath); isNetwork { // --output tcp://…
+		// resume where the previous run was in the stream of the receiver, it
+		// doesn't write twice the bytes it has (not when compressing, the stream
+		// isn't a copy of FILE)
+		streamStart := dumpdealloc.StreamOffsetUnknown
+		if options.Checkpoint != nil && len(compressAlgorithm) == 0 {
+			streamStart = options.Checkpoint.Stream()
+		}
 
-		// erase (collapse) the read bytes from file
-		err = unix.Ftruncate(int(file.Fd()), 0)
+		var source string
+		source, err = dumpdealloc.NetSourceName(file)
 		if err != nil {
-			log.Print(flag.Arg(0), " dumped but truncate fail")
-			log.Printf("main, unix.Ftruncate err='%v'", err)
-			return 1
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, NetSourceName err='%v'", err)
+			return exitFailure
 		}
+		outputNet, err = dumpdealloc.DialNetOutput(network, address, source, streamStart)
+		if err != nil {
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, DialNetOutput err='%v'", err)
+			return exitFailure
+		}
+		defer outputNet.Close()
+		outputNet.Logger = libraryLogger
+		output, outputSink = outputNet, outputNet
+	} else if len(outputPath) != 0 { // --output
+		var outputFile *dumpdealloc.FileOutput
+		outputFile, err = dumpdealloc.OpenFileOutput(outputPath, outputAppend, int64(syncEvery))
+		if err != nil {
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, OpenFileOutput err='%v'", err)
+			return exitFailure
+		}
+		defer outputFile.Close()
+		output, outputSink = outputFile, outputFile
+	}
 
-	} else if remove { // --remove
+	var compressor *dumpdealloc.CompressWriter
+	if len(compressAlgorithm) != 0 { // --compress
+		compressor, err = dumpdealloc.NewCompressWriter(output, compressAlgorithm, compressLevel)
+		if err != nil {
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, NewCompressWriter err='%v'", err)
+			return exitFailure
+		}
+		output = compressor
+	}
 
-		// before removing it, we close file
-		err = file.Close()
-		// file.Close() will be call by defer
-		// so we "disable" it by making file nil
-		file = nil
+	if options.Checkpoint != nil {
+		streamStart := dumpdealloc.StreamOffsetUnknown
+		if outputNet != nil && compressor == nil {
+			streamStart = outputNet.Base()
+		}
+		err = options.Checkpoint.SetStream(streamStart)
 		if err != nil {
-			log.Printf("%s dumped but close fail", flag.Arg(0))
-			log.Print("main, file.Close err='%v'", err)
-			return 1
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, SetStream err='%v'", err)
+			return exitFailure
+		}
+	}
+
+	// on SIGINT/SIGTERM, finish the current chunk and stop
+	// (with --follow it is the normal way to stop, otherwise the dump is interrupted)
+	// a second signal kill us
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
+	go func() {
+		receivedSignal := <-signals
+		if follow {
+			log.Printf("received %v, stop following", receivedSignal)
+		} else {
+			log.Printf("received %v, stop after the current chunk", receivedSignal)
 		}
+		signal.Stop(signals)
+		stop()
+	}()
 
-		// remove file
-		err = os.Remove(flag.Arg(0))
+	if len(controlSocket) != 0 { // --control-socket
+		var controlListener net.Listener
+		controlListener, err = net.Listen("unix", controlSocket)
 		if err != nil {
-			log.Printf("%s dumped but remove fail", flag.Arg(0))
-			log.Printf("main, os.Remove err='%v'", err)
-			return 1
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, net.Listen err='%v'", err)
+			return exitFailure
+		}
+		defer os.Remove(controlSocket)
+		defer controlListener.Close()
+
+		options.Control = dumpdealloc.NewController(stop)
+		options.Control.Logger = libraryLogger
+		go options.Control.Serve(controlListener)
+	}
+
+	var reporter *progressReporter
+	if progressLine || progressFd != progressFdDefault { // --progress, --progress-fd
+		var reporterLine, reporterEvents io.Writer
+		if progressLine {
+			reporterLine = os.Stderr
+		}
+		if progressFd != progressFdDefault {
+			_, err = unix.FcntlInt(uintptr(progressFd), unix.F_GETFD, 0)
+			if err != nil {
+				log.Print(flag.Arg(0), " untouched")
+				log.Printf("main, progress fd %d err='%v'", progressFd, err)
+				return exitFailure
+			}
+			reporterEvents = os.NewFile(uintptr(progressFd), "progress-fd")
+		}
+		reporter = newProgressReporter(file, reporterLine, reporterEvents)
+		options.Hooks.AfterChunk = reporter.Chunk
+	}
+
+	// the end of the stream is written before the end action
+	afterDumpDone := false
+	options.Hooks.AfterDump = func(result dumpdealloc.Result) error {
+		if reporter != nil {
+			reporter.End(result)
+		}
+
+		if options.Checkpoint == nil && !dumpLeadingHole && result.StartOffset > 0 {
+			log.Printf("%s: skipped the first %d bytes (hole, already deallocated)", flag.Arg(0), result.StartOffset)
+		}
+
+		if compressor != nil {
+			// end the compressed stream
+			err := compressor.Close()
+			if err != nil {
+				log.Print(flag.Arg(0), " dumped but the compressed stream can't be ended")
+				return err
+			}
+		}
+
+		if outputSink != nil {
+			// the end of the compressed stream (if any) has to be durable too
+			err := outputSink.Flush()
+			if err != nil {
+				log.Print(flag.Arg(0), " dumped but ", outputPath, " can't be flushed")
+				return err
+			}
+		}
+
+		log.Printf("%s: %d bytes dumped, %d bytes freed by punch-holes, %d bytes returned to the filesystem (st_blocks %d → %d)",
+			flag.Arg(0), result.ByteWritten, result.ByteFreed, result.ByteReclaimed, result.BlocksStart, result.BlocksEnd)
+		if result.ByteFreed > 0 && result.ByteReclaimed == 0 && !requireReclaim {
+			log.Printf("warning: the filesystem of %s doesn't seem to free punched blocks", flag.Arg(0))
+		}
+		afterDumpDone = true
+		return nil
+	}
+
+	// main function
+	result, err := dumpdealloc.Drain(ctx, file, output, options)
+	if reporter != nil {
+		reporter.End(result)
+	}
+	summary.drained(result, err, afterDumpDone)
+	summary.stat(file, false)
+	if err != nil {
+		if result.Interrupted && errors.Is(err, context.Canceled) {
+			log.Printf("%s interrupted, %d bytes dumped, end action skipped", flag.Arg(0), result.ByteWritten)
+			log.Printf("%s: resume offset %d", flag.Arg(0), result.SafeResumeOffset)
+			return exitInterrupted
+		}
+		var strategyErr *dumpdealloc.StrategyError
+		if errors.As(err, &strategyErr) { // --strategy
+			log.Print(flag.Arg(0), " untouched")
+			log.Printf("main, Drain err='%v'", err)
+			return exitFailure
 		}
+		if err == dumpdealloc.ErrFileTruncated { // --follow
+			log.Printf("%s truncated below the %d bytes dumped (copytruncate?), end action skipped",
+				flag.Arg(0), result.ByteDeallocated)
+		}
+		if !result.Dumped {
+			log.Print(flag.Arg(0), " may have been modified")
+			log.Printf("%s: %d bytes dumped, deallocated up to %d, safe resume offset %d",
+				flag.Arg(0), result.ByteWritten, result.ByteDeallocated, result.SafeResumeOffset)
+			log.Printf("main, Drain err='%v'", err)
+			return ExitCode(err, result.Dumped, exitModified)
+		}
+		if err == dumpdealloc.ErrNothingReclaimed { // --require-reclaim
+			log.Print(flag.Arg(0), " dumped but the punch-holes freed nothing")
+			return exitFailure
+		}
+		var openersErr *dumpdealloc.OpenersError
+		if errors.As(err, &openersErr) { // without --force
+			log.Printf("%s dumped but %v, holes left in place (use --force)", flag.Arg(0), err)
+			return exitFailure
+		}
+		if err == dumpdealloc.ErrTruncateRefused { // --truncate
+			if len(result.EndLock) == 0 {
+				log.Print(flag.Arg(0), " dumped but another process holds a flock on it, truncate refused, holes left in place")
+			} else {
+				log.Printf("%s dumped but it grew during the truncate (lock: %s), truncate refused, holes left in place",
+					flag.Arg(0), result.EndLock)
+			}
+			return exitFailure
+		}
+		if err == dumpdealloc.ErrRewriteRefused { // copy-rename
+			log.Print(flag.Arg(0), " dumped but it has been opened or grew during its rewrite, copy-rename refused, left as is")
+			return exitFailure
+		}
+		if err == dumpdealloc.ErrFileGrown { // --snapshot
+			log.Printf("%s dumped up to its size at the start (%d bytes) but it grew, %v refused",
+				flag.Arg(0), result.SnapshotSize, result.EndAction)
+			return exitFailure
+		}
+		if afterDumpDone {
+			log.Printf("%s dumped but %v fail", flag.Arg(0), result.EndAction)
+		}
+		log.Printf("main, Drain err='%v'", err)
+		return ExitCode(err, result.Dumped, exitFailure)
+	}
+	return exitOk
+}
+
+/**
+ * Return the exit code corresponding to the class of err (returned by
+ * dumpdealloc.Drain), or defaultCode if it doesn't belong to any.
+ * A *CollapseError is only exitCollapse once file has been dumped (dumped),
+ * the collapses during the dump (--collapse-every) get defaultCode.
+ */
+func ExitCode(err error, dumped bool, defaultCode int) int {
+	var readErr *dumpdealloc.ReadError
+	var writeErr *dumpdealloc.WriteError
+	var punchErr *dumpdealloc.PunchError
+	var collapseErr *dumpdealloc.CollapseError
+
+	switch {
+	case errors.As(err, &readErr):
+		return exitRead
+	case errors.As(err, &writeErr):
+		return exitWrite
+	case errors.As(err, &punchErr):
+		return exitPunch
+	case errors.As(err, &collapseErr) && dumped:
+		return exitCollapse
+	}
+	return defaultCode
+}
+
+// dump-deallocate receive
+func mainReceive(arguments []string) (exitCode int) {
+	err := receiveFlags.Parse(arguments)
+	if err != nil {
+		return exitFailure
+	}
+
+	err = PostParsingCheckReceiveFlags()
+	if err != nil {
+		log.Printf("mainReceive, PostParsingCheckReceiveFlags err='%v'", err)
+		return exitFailure
+	}
+
+	network, address, isNetwork := dumpdealloc.ParseNetworkAddress(receiveListen)
+	if !isNetwork {
+		network, address = "tcp", receiveListen
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Printf("mainReceive, net.Listen err='%v'", err)
+		return exitFailure
+	}
+	if network == "unix" {
+		defer os.Remove(address)
+	}
+
+	// stop on SIGINT/SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
+	go func() {
+		receivedSignal := <-signals
+		log.Printf("received %v, stop receiving", receivedSignal)
+		listener.Close()
+	}()
+
+	log.Printf("receiving on %s in %s", listener.Addr(), receiveDir)
+	receiver := dumpdealloc.NewReceiver(receiveDir)
+	receiver.Logger = libraryLogger
+	err = receiver.Serve(listener)
+	if err != nil {
+		log.Printf("mainReceive, receiver.Serve err='%v'", err)
+		return exitFailure
+	}
+	return exitOk
+}
+
+// dump-deallocate ctl
+func mainCtl(arguments []string) (exitCode int) {
+	err := ctlFlags.Parse(arguments)
+	if err != nil {
+		return exitFailure
+	}
+
+	command, err := PostParsingCheckCtlFlags()
+	if err != nil {
+		log.Printf("mainCtl, PostParsingCheckCtlFlags err='%v'", err)
+		return exitFailure
+	}
+
+	reply, err := dumpdealloc.ControlRequest(ctlSocket, command)
+	if err == dumpdealloc.ErrControlCommand {
+		log.Printf("mainCtl, %s: %s", command, reply)
+		return exitFailure
+	}
+	if err != nil {
+		log.Printf("mainCtl, ControlRequest err='%v'", err)
+		return exitFailure
+	}
+
+	fmt.Println(reply)
+	return exitOk
+}
+
+// dump-deallocate probe
+func mainProbe(arguments []string) (exitCode int) {
+	err := probeFlags.Parse(arguments)
+	if err != nil {
+		return exitFailure
+	}
+
+	path, err := PostParsingCheckProbeFlags()
+	if err != nil {
+		log.Printf("mainProbe, PostParsingCheckProbeFlags err='%v'", err)
+		return exitFailure
+	}
+
+	// the filesystem of a file is the one of its directory
+	dir := path
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		log.Printf("mainProbe, os.Stat err='%v'", err)
+		return exitFailure
+	}
+	if !fileInfo.IsDir() {
+		dir = filepath.Dir(path)
+	}
+
+	capabilities, err := dumpdealloc.Probe(dir)
+	if err != nil {
+		log.Printf("mainProbe, Probe err='%v'", err)
+		return exitFailure
+	}
+
+	report := newProbeReport(path, capabilities)
+	if probeJSON {
+		err = report.writeJSON(os.Stdout)
+	} else {
+		err = report.writeText(os.Stdout)
+	}
+	if err != nil {
+		log.Printf("mainProbe, write report err='%v'", err)
+		return exitFailure
 	}
-	return 0
+	return exitOk
 }
@@ -0,0 +1,120 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
+	"io"
+)
+
+// Report of dump-deallocate probe
+type probeReport struct {
+	Path         string          `json:"path"`
+	Filesystem   string          `json:"filesystem"`
+	BlockSize    int64           `json:"block_size"`
+	PunchHole    bool            `json:"punch_hole"`
+	ZeroRange    bool            `json:"zero_range"`
+	Collapse     bool            `json:"collapse_range"`
+	SeekHole     bool            `json:"seek_hole"`
+	Fiemap       bool            `json:"fiemap"`
+	Direct       bool            `json:"o_direct"`
+	Lease        bool            `json:"lease"`
+	Strategies   []probeStrategy `json:"strategies"`
+	AutoStrategy string          `json:"auto_strategy"` /* strategy chosen by --strategy auto */
+}
+
+type probeStrategy struct {
+	Strategy string `json:"strategy"`
+	Safe     bool   `json:"safe"`
+	Reason   string `json:"reason,omitempty"` /* why it isn't safe */
+}
+
+func newProbeReport(path string, capabilities dumpdealloc.Capabilities) *probeReport {
+	report := &probeReport{
+		Path:         path,
+		Filesystem:   capabilities.Filesystem,
+		BlockSize:    capabilities.BlockSize,
+		PunchHole:    capabilities.PunchHole,
+		ZeroRange:    capabilities.ZeroRange,
+		Collapse:     capabilities.Collapse,
+		SeekHole:     capabilities.SeekHole,
+		Fiemap:       capabilities.Fiemap,
+		Direct:       capabilities.Direct,
+		Lease:        capabilities.Lease,
+		AutoStrategy: capabilities.Strategy().String(),
+	}
+	for _, strategy := range []dumpdealloc.Strategy{
+		dumpdealloc.StrategyPunchHole, dumpdealloc.StrategyZeroRange, dumpdealloc.StrategyCopyRename} {
+		safe, reason := capabilities.Safe(strategy)
+		report.Strategies = append(report.Strategies, probeStrategy{Strategy: strategy.String(), Safe: safe, Reason: reason})
+	}
+	return report
+}
+
+// Write the report as one JSON line
+func (report *probeReport) writeJSON(writer io.Writer) error {
+	return json.NewEncoder(writer).Encode(report)
+}
+
+// Write the report as text, one line per capability
+func (report *probeReport) writeText(writer io.Writer) error {
+	yesNo := func(supported bool) string {
+		if supported {
+			return "yes"
+		}
+		return "no"
+	}
+
+	_, err := fmt.Fprintf(writer,
+		"path:            %s\n"+
+			"filesystem:      %s\n"+
+			"block size:      %d\n"+
+			"punch-hole:      %s\n"+
+			"zero-range:      %s\n"+
+			"collapse-range:  %s\n"+
+			"seek data/hole:  %s\n"+
+			"fiemap:          %s\n"+
+			"o_direct:        %s\n"+
+			"lease:           %s\n"+
+			"strategies:\n",
+		report.Path, report.Filesystem, report.BlockSize,
+		yesNo(report.PunchHole), yesNo(report.ZeroRange), yesNo(report.Collapse), yesNo(report.SeekHole),
+		yesNo(report.Fiemap), yesNo(report.Direct), yesNo(report.Lease))
+	if err != nil {
+		return err
+	}
+
+	for _, strategy := range report.Strategies {
+		safe := "safe"
+		if !strategy.Safe {
+			safe = "unsafe: " + strategy.Reason
+		}
+		_, err = fmt.Fprintf(writer, "  %-12s %s\n", strategy.Strategy, safe)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(writer, "auto strategy:   %s\n", report.AutoStrategy)
+	return err
+}
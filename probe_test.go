@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
+	"strings"
+	"testing"
+)
+
+func TestProbeReport(t *testing.T) {
+	capabilities := dumpdealloc.Capabilities{
+		Filesystem: "ext2/ext3/ext4",
+		BlockSize:  4096,
+		ZeroRange:  true,
+		Collapse:   true,
+		SeekHole:   true,
+	}
+	report := newProbeReport("/srv", capabilities)
+
+	var text bytes.Buffer
+	err := report.writeText(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"filesystem:      ext2/ext3/ext4\n",
+		"punch-hole:      no\n",
+		"zero-range:      yes\n",
+		"  punch-hole   unsafe: fallocate punch-hole not supported\n",
+		"  zero-range   safe\n",
+		"  copy-rename  unsafe: leases not supported",
+		"auto strategy:   copy-rename\n",
+	} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("expected %q in the report, got: %s", expected, text.String())
+		}
+	}
+
+	var output bytes.Buffer
+	err = report.writeJSON(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded probeReport
+	err = json.Unmarshal(output.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Path != "/srv" || decoded.BlockSize != 4096 || !decoded.Collapse || decoded.Lease ||
+		decoded.AutoStrategy != "copy-rename" || len(decoded.Strategies) != 3 || decoded.Strategies[1].Safe != true {
+		t.Errorf("unexpected JSON report: %s", output.String())
+	}
+}
@@ -0,0 +1,174 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// minimum duration between two progress reports (--progress and --progress-fd)
+var progressInterval = time.Second
+
+/**
+ * Report the progress of the dump of file, from the counters given to the
+ * AfterChunk hook: a line refreshed on stderr (--progress) and/or JSON events,
+ * one per line (--progress-fd).
+ */
+type progressReporter struct {
+	file   *os.File
+	line   io.Writer /* nil without --progress */
+	events io.Writer /* nil without --progress-fd */
+
+	start      time.Time
+	lastReport time.Time
+	lineLength int /* length of the last line printed, to erase it */
+	ended      bool
+}
+
+/**
+ * Progress event written on --progress-fd, "event" is "progress" or "end"
+ * (once, at the end of the dump). eta_seconds is -1 when unknown.
+ */
+type progressEvent struct {
+	Event          string  `json:"event"`
+	Offset         int64   `json:"offset"`
+	BytesCollapsed int64   `json:"bytes_collapsed"`
+	BytesWritten   int64   `json:"bytes_written"`
+	BytesReclaimed int64   `json:"bytes_reclaimed"`
+	FileSize       int64   `json:"file_size"`
+	Rate           int64   `json:"rate"`
+	ETASeconds     int64   `json:"eta_seconds"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// the first report is progressInterval after the start (a throughput measured on one chunk is meaningless)
+func newProgressReporter(file *os.File, line io.Writer, events io.Writer) *progressReporter {
+	now := time.Now()
+	return &progressReporter{file: file, line: line, events: events, start: now, lastReport: now}
+}
+
+// AfterChunk hook, report at most once per progressInterval
+func (reporter *progressReporter) Chunk(progress dumpdealloc.Result) {
+	if time.Since(reporter.lastReport) < progressInterval {
+		return
+	}
+	reporter.report("progress", progress)
+}
+
+// Report the final counters (only the first call does something)
+func (reporter *progressReporter) End(result dumpdealloc.Result) {
+	if reporter.ended {
+		return
+	}
+	reporter.ended = true
+	reporter.report("end", result)
+	if reporter.line != nil {
+		fmt.Fprintln(reporter.line)
+	}
+}
+
+func (reporter *progressReporter) report(event string, progress dumpdealloc.Result) {
+	now := time.Now()
+	reporter.lastReport = now
+	elapsed := now.Sub(reporter.start)
+
+	// in follow mode, file keep growing
+	var fileSize int64
+	fileInfo, err := reporter.file.Stat()
+	if err == nil {
+		fileSize = fileInfo.Size()
+	}
+
+	var rate int64
+	if elapsed > 0 {
+		rate = int64(float64(progress.ByteWritten) / elapsed.Seconds())
+	}
+	eta := time.Duration(-1)
+	if rate > 0 {
+		remaining := fileSize - progress.ByteDeallocated
+		if remaining < 0 {
+			remaining = 0
+		}
+		eta = time.Duration(float64(remaining) / float64(rate) * float64(time.Second))
+	}
+
+	if reporter.line != nil {
+		// as if nothing had been collapsed (--collapse-every)
+		dumped, size := progress.ByteDeallocated+progress.ByteCollapsed, fileSize+progress.ByteCollapsed
+		percent := 100.0
+		if size > 0 {
+			percent = float64(dumped) * 100 / float64(size)
+		}
+		etaStr := "?"
+		if eta >= 0 {
+			etaStr = eta.Round(time.Second).String()
+		}
+		line := fmt.Sprintf("%s: %s/%s dumped (%.0f%%), %s reclaimed, %s/s, ETA %s",
+			reporter.file.Name(), formatBytes(dumped), formatBytes(size), percent,
+			formatBytes(progress.ByteReclaimed), formatBytes(rate), etaStr)
+		// erase the end of the previous line if it was longer
+		padding := ""
+		if len(line) < reporter.lineLength {
+			padding = strings.Repeat(" ", reporter.lineLength-len(line))
+		}
+		reporter.lineLength = len(line)
+		fmt.Fprintf(reporter.line, "\r%s%s", line, padding)
+	}
+
+	if reporter.events != nil {
+		etaSeconds := int64(-1)
+		if eta >= 0 {
+			etaSeconds = int64(eta.Round(time.Second) / time.Second)
+		}
+		// a failing consumer doesn't stop the dump
+		json.NewEncoder(reporter.events).Encode(progressEvent{
+			Event:          event,
+			Offset:         progress.ByteDeallocated,
+			BytesCollapsed: progress.ByteCollapsed,
+			BytesWritten:   progress.ByteWritten,
+			BytesReclaimed: progress.ByteReclaimed,
+			FileSize:       fileSize,
+			Rate:           rate,
+			ETASeconds:     etaSeconds,
+			ElapsedSeconds: elapsed.Seconds(),
+		})
+	}
+}
+
+// Format a number of bytes with an IEC unit (ex: 1.5MiB)
+func formatBytes(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 6 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, "KMGTPE"[unit-1])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	testCases := []struct {
+		input    int64
+		expected string
+	}{
+		{0,                "0B"},
+		{1023,             "1023B"},
+		{1024,             "1.0KiB"},
+		{1536,             "1.5KiB"},
+		{10 * 1024 * 1024, "10.0MiB"},
+		{1 << 62,          "4.0EiB"},
+	}
+
+	for _, tc := range testCases {
+		if result := formatBytes(tc.input); result != tc.expected {
+			t.Errorf("formatBytes(%d), expected: %s, got: %s", tc.input, tc.expected, result)
+		}
+	}
+}
+
+func TestProgressReporter(t *testing.T) {
+	file, err := ioutil.TempFile(".", "dump-deallocate-TestProgressReporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.Write(make([]byte, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var line, events bytes.Buffer
+	reporter := newProgressReporter(file, &line, &events)
+	// as if the reporter was created progressInterval ago
+	reporter.lastReport = reporter.lastReport.Add(-progressInterval)
+
+	reporter.Chunk(dumpdealloc.Result{ByteDeallocated: 1024, ByteWritten: 1024, ByteReclaimed: 512})
+	// less than progressInterval after the previous report, ignored
+	reporter.Chunk(dumpdealloc.Result{ByteDeallocated: 2048, ByteWritten: 2048})
+	reporter.End(dumpdealloc.Result{ByteDeallocated: 4096, ByteWritten: 4096, ByteReclaimed: 4096})
+	reporter.End(dumpdealloc.Result{})
+
+	if !strings.Contains(line.String(), "1.0KiB/4.0KiB dumped (25%), 512B reclaimed") {
+		t.Errorf("unexpected progress line: %q", line.String())
+	}
+	if strings.Contains(line.String(), "2.0KiB/4.0KiB") {
+		t.Errorf("progress reported twice in less than %v: %q", progressInterval, line.String())
+	}
+	if !strings.Contains(line.String(), ": 4.0KiB/4.0KiB dumped (100%), 4.0KiB reclaimed") ||
+		!strings.HasSuffix(line.String(), "\n") {
+		t.Errorf("unexpected end of progress line: %q", line.String())
+	}
+
+	decoder := json.NewDecoder(&events)
+	expectedEvents := []progressEvent{
+		{Event: "progress", Offset: 1024, BytesWritten: 1024, BytesReclaimed: 512, FileSize: 4096},
+		{Event: "end", Offset: 4096, BytesWritten: 4096, BytesReclaimed: 4096, FileSize: 4096},
+	}
+	for _, expected := range expectedEvents {
+		var event progressEvent
+		err = decoder.Decode(&event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != expected.Event || event.Offset != expected.Offset ||
+			event.BytesWritten != expected.BytesWritten || event.BytesReclaimed != expected.BytesReclaimed ||
+			event.FileSize != expected.FileSize {
+			t.Errorf("expected event: %+v, got: %+v", expected, event)
+		}
+	}
+	if decoder.More() {
+		t.Errorf("more events than expected")
+	}
+}
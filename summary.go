@@ -0,0 +1,165 @@
+/**
+ * dump-deallocate
+ *
+ * Copyright (C) 2017 Maxime de Roucy
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software Foundation,
+ * Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+/**
+ * Result of the run printed at exit with --summary=json, on one line.
+ * safe_resume_offset is only present when FILE may have been partially
+ * dumped (exit class modified, read, write, punch or interrupted).
+ */
+type runSummary struct {
+	File             string          `json:"file"`
+	InitialSize      int64           `json:"initial_size"`
+	ByteRead         int64           `json:"bytes_read"`
+	ByteWritten      int64           `json:"bytes_written"`
+	BytePunched      int64           `json:"bytes_punched"`
+	ByteReclaimed    int64           `json:"bytes_reclaimed"`
+	Strategy         string          `json:"strategy,omitempty"`  /* deallocation strategy used */
+	ZeroCopy         string          `json:"zero_copy,omitempty"` /* syscall writing on stdout without buffer */
+	EndAction        string          `json:"end_action"`
+	EndActionResult  string          `json:"end_action_result"`  /* done, failed, refused, skipped or none */
+	EndLock          string          `json:"end_lock,omitempty"` /* lock taken for the truncate */
+	Openers          []summaryOpener `json:"openers,omitempty"`  /* other processes having FILE open */
+	ByteCollapsed    int64           `json:"bytes_collapsed"`
+	FinalSize        int64           `json:"final_size"`
+	FinalBlocks      int64           `json:"final_blocks"` /* st_blocks, 512 bytes unit */
+	DurationSeconds  float64         `json:"duration_seconds"`
+	ExitCode         int             `json:"exit_code"`
+	ExitClass        string          `json:"exit_class"`
+	SafeResumeOffset *int64          `json:"safe_resume_offset,omitempty"`
+	Error            string          `json:"error,omitempty"`
+
+	start  time.Time
+	result *dumpdealloc.Result /* nil if Drain hasn't been called */
+}
+
+type summaryOpener struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{EndAction: dumpdealloc.EndNone.String(), EndActionResult: "none", start: time.Now()}
+}
+
+// Record the size and st_blocks of file, before the dump (initial) or after
+func (summary *runSummary) stat(file *os.File, initial bool) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if initial {
+		summary.InitialSize = fileInfo.Size()
+		return
+	}
+	summary.FinalSize = fileInfo.Size()
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		summary.FinalBlocks = stat.Blocks
+	}
+}
+
+/**
+ * Record what Drain did, afterDumpDone tell if the AfterDump hook succeeded
+ * (the end action is attempted after it).
+ */
+func (summary *runSummary) drained(result dumpdealloc.Result, err error, afterDumpDone bool) {
+	summary.result = &result
+	summary.ByteRead = result.ByteRead
+	summary.ByteWritten = result.ByteWritten
+	summary.BytePunched = result.ByteFreed
+	summary.ByteReclaimed = result.ByteReclaimed
+	summary.ByteCollapsed = result.ByteCollapsed
+	summary.EndLock = result.EndLock
+	if result.Strategy != dumpdealloc.StrategyAuto {
+		summary.Strategy = result.Strategy.String()
+	}
+	summary.ZeroCopy = result.ZeroCopy
+
+	summary.EndAction = result.EndAction.String()
+	var openersErr *dumpdealloc.OpenersError
+	switch {
+	case result.EndAction == dumpdealloc.EndNone:
+		summary.EndActionResult = "none"
+	case !afterDumpDone || result.Interrupted || err == dumpdealloc.ErrNothingReclaimed:
+		summary.EndActionResult = "skipped"
+	case err == dumpdealloc.ErrTruncateRefused || err == dumpdealloc.ErrFileGrown || err == dumpdealloc.ErrRewriteRefused:
+		summary.EndActionResult = "refused"
+	case errors.As(err, &openersErr):
+		summary.EndActionResult = "refused"
+		for _, opener := range openersErr.Openers {
+			summary.Openers = append(summary.Openers, summaryOpener{PID: opener.PID, Command: opener.Command})
+		}
+	case err != nil:
+		summary.EndActionResult = "failed"
+	default:
+		summary.EndActionResult = "done"
+	}
+}
+
+// Write the summary as one JSON line
+func (summary *runSummary) write(writer io.Writer, exitCode int, err error) error {
+	summary.DurationSeconds = time.Since(summary.start).Seconds()
+	summary.ExitCode = exitCode
+	summary.ExitClass = exitClass(exitCode)
+	if exitCode != exitOk && err != nil {
+		summary.Error = err.Error()
+	}
+	switch exitCode {
+	case exitModified, exitRead, exitWrite, exitPunch, exitInterrupted:
+		if summary.result != nil {
+			summary.SafeResumeOffset = &summary.result.SafeResumeOffset
+		}
+	}
+	return json.NewEncoder(writer).Encode(summary)
+}
+
+// Name of the class of an exit code (see "Exit status" in the usage)
+func exitClass(exitCode int) string {
+	switch exitCode {
+	case exitOk:
+		return "ok"
+	case exitFailure:
+		return "failure"
+	case exitModified:
+		return "modified"
+	case exitRead:
+		return "read"
+	case exitWrite:
+		return "write"
+	case exitPunch:
+		return "punch"
+	case exitCollapse:
+		return "collapse"
+	case exitInterrupted:
+		return "interrupted"
+	}
+	return "unknown"
+}
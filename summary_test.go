@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/tchernomax/dump-deallocate/dumpdealloc"
+	"testing"
+)
+
+func TestRunSummary(t *testing.T) {
+	result := dumpdealloc.Result{ByteRead: 8192, ByteWritten: 4096, ByteFreed: 4096, SafeResumeOffset: 4096}
+	writeErr := &dumpdealloc.WriteError{Offset: 4096, ByteToWrite: 4096, Err: errors.New("broken")}
+
+	testCases := []struct {
+		name              string
+		endAction         dumpdealloc.EndAction
+		result            dumpdealloc.Result
+		err               error
+		afterDumpDone     bool
+		exitCode          int
+		expectedEndResult string
+		expectedClass     string
+		expectedResume    bool
+	}{
+		{"ok",          dumpdealloc.EndNone,     result, nil,      true,  exitOk,       "none",    "ok",       false},
+		{"truncated",   dumpdealloc.EndTruncate, result, nil,      true,  exitOk,       "done",    "ok",       false},
+		{"write error", dumpdealloc.EndTruncate, result, writeErr, false, exitWrite,    "skipped", "write",    true},
+		{"collapse",    dumpdealloc.EndCollapse, result, &dumpdealloc.CollapseError{Err: errors.New("no")}, true, exitCollapse, "failed", "collapse", false},
+		{"truncate refused", dumpdealloc.EndTruncate, result, dumpdealloc.ErrTruncateRefused, true, exitFailure, "refused", "failure", false},
+		{"open elsewhere", dumpdealloc.EndRemove, result, &dumpdealloc.OpenersError{Action: dumpdealloc.EndRemove}, true, exitFailure, "refused", "failure", false},
+		{"nothing reclaimed", dumpdealloc.EndRemove, result, dumpdealloc.ErrNothingReclaimed, true, exitFailure, "skipped", "failure", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			summary := newRunSummary()
+			summary.File = "test"
+			tc.result.EndAction = tc.endAction
+			summary.drained(tc.result, tc.err, tc.afterDumpDone)
+
+			var output bytes.Buffer
+			err := summary.write(&output, tc.exitCode, tc.err)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded map[string]interface{}
+			err = json.Unmarshal(output.Bytes(), &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded["file"] != "test" || decoded["bytes_read"] != 8192.0 || decoded["bytes_written"] != 4096.0 {
+				t.Errorf("unexpected counters: %s", output.String())
+			}
+			if decoded["end_action"] != tc.endAction.String() || decoded["end_action_result"] != tc.expectedEndResult {
+				t.Errorf("end action, expected: %s %s, got: %v %v",
+					tc.endAction, tc.expectedEndResult, decoded["end_action"], decoded["end_action_result"])
+			}
+			if decoded["exit_code"] != float64(tc.exitCode) || decoded["exit_class"] != tc.expectedClass {
+				t.Errorf("exit, expected: %d %s, got: %v %v", tc.exitCode, tc.expectedClass, decoded["exit_code"], decoded["exit_class"])
+			}
+			_, haveResume := decoded["safe_resume_offset"]
+			if haveResume != tc.expectedResume {
+				t.Errorf("safe_resume_offset presence, expected: %v, got: %s", tc.expectedResume, output.String())
+			}
+			_, haveError := decoded["error"]
+			if haveError != (tc.err != nil) {
+				t.Errorf("error presence, expected: %v, got: %s", tc.err != nil, output.String())
+			}
+		})
+	}
+}